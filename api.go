@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/display"
+	"git.sr.ht/~kota/hex/hb"
+	"github.com/julienschmidt/httprouter"
+)
+
+// API_VERSION is the version of the JSON API. The structures below are part
+// of the API so fields must not be renamed or removed without increasing it.
+// The API is served under /api/v1 and, for the latest version, /api.
+const API_VERSION = 1
+
+type apiResponse struct {
+	Version int         `json:"version"`
+	Stale   bool        `json:"stale"`
+	Data    interface{} `json:"data"`
+}
+
+type apiError struct {
+	Version int    `json:"version"`
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+}
+
+type apiCreator struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type apiPost struct {
+	ID           int        `json:"id"`
+	Title        string     `json:"title"`
+	URL          string     `json:"url,omitempty"`
+	Image        string     `json:"image,omitempty"`
+	Body         string     `json:"body"`
+	Community    string     `json:"community"`
+	Creator      apiCreator `json:"creator"`
+	Upvotes      int        `json:"upvotes"`
+	CommentCount int        `json:"comment_count"`
+	Featured     bool       `json:"featured"`
+	Published    time.Time  `json:"published"`
+	Updated      *time.Time `json:"updated"`
+}
+
+type apiComment struct {
+	ID         int          `json:"id"`
+	PostID     int          `json:"post_id"`
+	Path       string       `json:"path"`
+	Content    string       `json:"content"`
+	Creator    apiCreator   `json:"creator"`
+	Upvotes    int          `json:"upvotes"`
+	ChildCount int          `json:"child_count"`
+	Missing    bool         `json:"missing,omitempty"`
+	Published  time.Time    `json:"published"`
+	Updated    *time.Time   `json:"updated"`
+	Replies    []apiComment `json:"replies"`
+}
+
+type apiCommunity struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type apiPage struct {
+	Community *apiCommunity `json:"community,omitempty"`
+	Page      int           `json:"page"`
+	Sort      string        `json:"sort"`
+	Posts     []apiPost     `json:"posts"`
+}
+
+type apiComments struct {
+	PostID   int          `json:"post_id"`
+	Page     int          `json:"page"`
+	Sort     string       `json:"sort"`
+	More     bool         `json:"more"`
+	Comments []apiComment `json:"comments"`
+}
+
+type apiPerson struct {
+	Name         string    `json:"name"`
+	DisplayName  string    `json:"display_name"`
+	URL          string    `json:"url"`
+	Bio          string    `json:"bio"`
+	Local        bool      `json:"local"`
+	CommentCount int       `json:"comment_count"`
+	PostCount    int       `json:"post_count"`
+	Published    time.Time `json:"published"`
+	Posts        []apiPost `json:"posts"`
+}
+
+// isAPI reports whether a request is for the JSON API.
+func isAPI(r *http.Request) bool {
+	return r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// writeJSON writes a value as the JSON response.
+func (app *application) writeJSON(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	v interface{},
+) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		app.errLog.Output(2, err.Error())
+		http.Error(
+			w,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// apiRespond writes data in the API's response envelope.
+func (app *application) apiRespond(
+	w http.ResponseWriter,
+	r *http.Request,
+	stale bool,
+	data interface{},
+) {
+	app.writeJSON(w, r, http.StatusOK, apiResponse{
+		Version: API_VERSION,
+		Stale:   stale,
+		Data:    data,
+	})
+}
+
+// apiHome handles the posts on the home page.
+func (app *application) apiHome(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sort := hb.ParseSortType(q.Get("sort"))
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	page, err := app.cache.Home(ctx, app.client, pageNum, sort)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	posts, stale, err := app.apiPosts(ctx, page.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	app.apiRespond(w, r, page.Stale || stale, apiPage{
+		Page:  pageNum,
+		Sort:  string(sort),
+		Posts: posts,
+	})
+}
+
+// apiCommunity handles a community and the posts in it.
+func (app *application) apiCommunity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sort := hb.ParseSortType(q.Get("sort"))
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+	params := httprouter.ParamsFromContext(r.Context())
+	name := params.ByName("name")
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	community, err := app.cache.Community(ctx, app.client, name)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	page, err := app.cache.CommunityPosts(ctx, app.client, name, pageNum, sort)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	posts, stale, err := app.apiPosts(ctx, page.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	c := newAPICommunity(community)
+	app.apiRespond(w, r, page.Stale || stale, apiPage{
+		Community: &c,
+		Page:      pageNum,
+		Sort:      string(sort),
+		Posts:     posts,
+	})
+}
+
+// apiCommunities handles the list of communities.
+func (app *application) apiCommunities(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	cms, err := app.cache.Communities(ctx, app.client)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	communities := make([]apiCommunity, 0, len(cms))
+	for _, community := range cms {
+		communities = append(communities, newAPICommunity(community))
+	}
+	app.apiRespond(w, r, false, communities)
+}
+
+// apiPost handles a single post.
+func (app *application) apiPost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	post, err := app.cache.Post(ctx, app.client, id)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	app.apiRespond(w, r, post.Stale, newAPIPost(post))
+}
+
+// apiComments handles a page of comments on a post. Each page has the same
+// number of top level comments as the post's page does, with all of their
+// loaded replies.
+func (app *application) apiComments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sort := hb.ParseCommentSortType(q.Get("sort"))
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	top := app.commentTop
+	comments, err := app.cache.Comments(ctx, app.client, id, sort, pageNum*top)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	roots, more := comments.Page(pageNum, top)
+	app.apiRespond(w, r, comments.Stale, apiComments{
+		PostID:   id,
+		Page:     pageNum,
+		Sort:     string(sort),
+		More:     more && pageNum < display.MAX_PAGE,
+		Comments: newAPIComments(roots),
+	})
+}
+
+// apiUser handles a user and their posts.
+func (app *application) apiUser(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	name := params.ByName("name")
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	user, err := app.cache.Person(ctx, app.client, name)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	posts, stale, err := app.apiPosts(ctx, user.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	app.apiRespond(w, r, user.Stale || stale, apiPerson{
+		Name:         user.Name,
+		DisplayName:  user.DisplayName,
+		URL:          user.URL,
+		Bio:          string(user.Bio),
+		Local:        user.Local,
+		CommentCount: user.CommentCount,
+		PostCount:    user.PostCount,
+		Published:    user.Published,
+		Posts:        posts,
+	})
+}
+
+// apiPosts looks up posts and converts them for the API. It also reports if
+// any of them are stale.
+func (app *application) apiPosts(
+	ctx context.Context,
+	ids []int,
+) ([]apiPost, bool, error) {
+	posts := make([]apiPost, 0, len(ids))
+	var stale bool
+	for _, id := range ids {
+		post, err := app.cache.Post(ctx, app.client, id)
+		if err != nil {
+			return nil, false, err
+		}
+		stale = stale || post.Stale
+		posts = append(posts, newAPIPost(post))
+	}
+	return posts, stale, nil
+}
+
+func newAPIPost(post cache.Post) apiPost {
+	return apiPost{
+		ID:           post.ID,
+		Title:        post.Name,
+		URL:          post.URL,
+		Image:        post.Image,
+		Body:         string(post.Body),
+		Community:    post.CommunityName,
+		Creator:      apiCreator{post.CreatorDisplayName, post.CreatorURL},
+		Upvotes:      post.Upvotes,
+		CommentCount: post.CommentCount,
+		Featured:     post.FeaturedCommunity || post.FeaturedLocal,
+		Published:    post.Published,
+		Updated:      post.Updated,
+	}
+}
+
+func newAPIComments(comments []*cache.Comment) []apiComment {
+	converted := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		converted = append(converted, apiComment{
+			ID:         c.ID,
+			PostID:     c.PostID,
+			Path:       c.Path,
+			Content:    string(c.Content),
+			Creator:    apiCreator{c.CreatorDisplayName, c.CreatorURL},
+			Upvotes:    c.Upvotes,
+			ChildCount: c.ChildCount,
+			Missing:    c.Missing,
+			Published:  c.Published,
+			Updated:    c.Updated,
+			Replies:    newAPIComments(c.Children),
+		})
+	}
+	return converted
+}
+
+func newAPICommunity(community cache.Community) apiCommunity {
+	return apiCommunity{
+		ID:          community.ID,
+		Name:        community.Name,
+		Title:       community.Title,
+		Description: community.Description,
+	}
+}
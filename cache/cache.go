@@ -1,32 +1,146 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~kota/hex/hb"
 	"github.com/yuin/goldmark"
 )
 
+const (
+	// MAX_STALE is the default for Options.MaxStale.
+	MAX_STALE = time.Hour * 6
+
+	// Default entry limits for each part of the cache. Comments are limited
+	// the most since a single entry holds every comment on a post.
+	MAX_PAGES    = 2000
+	MAX_POSTS    = 50000
+	MAX_COMMENTS = 2000
+	MAX_PERSONS  = 5000
+	MAX_SEARCHES = 1000
+
+	// MAX_COMMENT_REFS limits how many comment IDs are remembered along with
+	// where to find them.
+	MAX_COMMENT_REFS = 100000
+
+	// JANITOR_INTERVAL is how often data too old to be served is removed.
+	JANITOR_INTERVAL = time.Minute * 5
+
+	// COMMUNITY_TTL is the default for Options.CommunityTTL.
+	COMMUNITY_TTL = time.Hour
+
+	// SNAPSHOT_INTERVAL is the default for Options.SnapshotInterval.
+	SNAPSHOT_INTERVAL = time.Minute * 10
+
+	// BACKGROUND_TIMEOUT is the default for Options.BackgroundTimeout.
+	BACKGROUND_TIMEOUT = time.Minute * 2
+)
+
+// Options configures the behaviour of a Cache.
+type Options struct {
+	// MaxStale is how old cached data may be before it's no longer served.
+	// Expired data younger than this is served immediately while fresh data
+	// is fetched in the background, and continues to be served if that fetch
+	// fails. Data older than this must be fetched before it's served.
+	MaxStale time.Duration
+
+	// CommunityTTL is how long the list of communities is cached before it's
+	// refreshed in the background.
+	CommunityTTL time.Duration
+
+	// PageTTL, PostTTL, PersonTTL, and SearchTTL are how long pages of
+	// posts, posts and their comments, users, and search results are served
+	// before they're refreshed. Zero means the default.
+	PageTTL   time.Duration
+	PostTTL   time.Duration
+	PersonTTL time.Duration
+	SearchTTL time.Duration
+
+	// PostsPerPage is how many posts are requested for each page, at most
+	// POSTS_PER_PAGE. Zero means POSTS_PER_PAGE.
+	PostsPerPage int
+
+	// ListingType filters which posts are listed. Empty means
+	// hb.ListingTypeLocal. The list of communities is always local.
+	ListingType hb.ListingType
+
+	// MaxPages, MaxPosts, MaxComments, MaxPersons, and MaxSearches limit the
+	// number of entries in each part of the cache. Once full the least
+	// recently used entries are evicted. Zero means no limit.
+	// MaxPages applies separately to the home page and community pages.
+	// MaxComments is the number of posts with cached comments.
+	MaxPages    int
+	MaxPosts    int
+	MaxComments int
+	MaxPersons  int
+	MaxSearches int
+
+	// SnapshotPath is a file the cache is saved to periodically and loaded
+	// from when initialized. An empty path disables snapshots.
+	SnapshotPath string
+
+	// SnapshotInterval is how often the snapshot is saved.
+	SnapshotInterval time.Duration
+
+	// Backend selects where the cache is stored, either BackendMemory or
+	// BackendDisk. Empty means BackendMemory.
+	Backend string
+
+	// Dir is the directory used by BackendDisk.
+	Dir string
+
+	// RefreshInterval is how often the most requested pages are checked and
+	// refreshed if they're close to expiring.
+	RefreshInterval time.Duration
+
+	// RefreshBudget is the maximum number of hexbear requests per minute made
+	// to keep popular pages warm. Zero disables refreshing.
+	RefreshBudget int
+
+	// BackgroundTimeout limits how long fetches which nobody is waiting on,
+	// such as refreshes, may take.
+	BackgroundTimeout time.Duration
+
+	// Host is the hostname of the instance without a leading www. Posts
+	// linking to images it hosts show the image.
+	Host string
+}
+
 // The Cache is used to serve all requests. When available and fresh cached
 // data is used, but fresh data will be fetched as needed.
 type Cache struct {
 	infoLog *log.Logger
 	errLog  *log.Logger
 
+	// cli is used for fetches made in the background.
+	cli *hb.Client
+
 	markdown      goldmark.Markdown
 	emojiReplacer *strings.Replacer
 	linkReplacer  *strings.Replacer
 
+	host              string
+	snapshotPath      string
+	backgroundTimeout time.Duration
+	postsPerPage      int
+	listingType       hb.ListingType
+
+	// ttls holds the settings which can be changed with Reload.
+	ttls atomic.Pointer[ttls]
+
 	// home is a mapping of page_number:sorting_method to lists of posts.
 	home homeCache
 
 	// communities is a mapping of community names to information about that
-	// community.
-	// The communities themselves contain a mapping of pages to lists of posts.
+	// community along with a mapping of pages to lists of posts.
 	communities communityCache
 
 	// posts is a mapping of post IDs to the data representing them.
@@ -38,148 +152,212 @@ type Cache struct {
 
 	// persons is a mapping of usernames to information about that person.
 	persons personCache
+
+	// searches is a mapping of search parameters to their results. Searches
+	// are not saved in snapshots as they expire quickly.
+	searches store[string, SearchResults]
+
+	// commentRefs is a mapping of comment IDs to their post and path. It's
+	// only kept in memory as it's cheap to rebuild.
+	commentRefs *lru[int, commentRef]
+
+	// flights deduplicates concurrent fetches so that a burst of requests for
+	// the same uncached data only results in one set of requests to hexbear.
+	flights flight
+
+	// hits counts requests for listings so that popular ones can be kept
+	// warm.
+	hits hits
+
+	// done is closed by Close to stop the background work, which is
+	// tracked by background so Close can wait for it.
+	done       chan struct{}
+	closing    sync.RWMutex
+	closed     bool
+	background sync.WaitGroup
 }
 
 type homeCache struct {
-	mutex *sync.RWMutex
-	cache map[string]Page
+	cache store[string, Page]
 }
 
-func newHomeCache() homeCache {
+func newHomeCache(s store[string, Page]) homeCache {
 	var c homeCache
-	c.mutex = new(sync.RWMutex)
-	c.cache = make(map[string]Page)
+	c.cache = s
 	return c
 }
 
 func (c homeCache) get(num int, sort hb.SortType) (Page, bool) {
-	c.mutex.RLock()
 	key := strconv.Itoa(num) + ":" + string(sort)
-	home, ok := c.cache[key]
-	c.mutex.RUnlock()
-	return home, ok
+	return c.cache.get(key)
 }
 
 func (c homeCache) set(num int, sort hb.SortType, home Page) {
-	c.mutex.Lock()
 	key := strconv.Itoa(num) + ":" + string(sort)
-	c.cache[key] = home
-	c.mutex.Unlock()
+	c.cache.set(key, home)
 }
 
 type communityCache struct {
-	mutex *sync.RWMutex
-	cache map[string]Community
+	cache store[string, Community]
+
+	// pages is a mapping of community_name:page_number:sorting_method to lists
+	// of posts. It's shared by all communities so that it can be bounded as a
+	// whole. Since the pages are kept separately, replacing a community's
+	// information does not drop its pages.
+	pages store[string, Page]
+
+	// fetched is when the list of communities was last fetched in unix
+	// nanoseconds.
+	fetched *atomic.Int64
 }
 
-func newCommunityCache() communityCache {
+func newCommunityCache(
+	s store[string, Community],
+	pages store[string, Page],
+) communityCache {
 	var c communityCache
-	c.mutex = new(sync.RWMutex)
-	c.cache = make(map[string]Community)
+	c.cache = s
+	c.pages = pages
+	c.fetched = new(atomic.Int64)
 	return c
 }
 
 func (c communityCache) get(name string) (Community, bool) {
-	c.mutex.RLock()
-	community, ok := c.cache[name]
-	c.mutex.RUnlock()
-	return community, ok
+	return c.cache.get(name)
 }
 
 func (c communityCache) getAll() []Community {
 	var cms []Community
-	c.mutex.RLock()
-	for _, cm := range c.cache {
-		cms = append(cms, cm)
+	for _, item := range c.cache.dump() {
+		cms = append(cms, item.Value)
 	}
-	c.mutex.RUnlock()
 	return cms
 }
 
 func (c communityCache) set(name string, community Community) {
-	c.mutex.Lock()
-	c.cache[name] = community
-	c.mutex.Unlock()
+	c.cache.set(name, community)
+}
+
+// remove deletes a community along with all of its pages.
+func (c communityCache) remove(name string) {
+	c.cache.remove(name)
+	c.pages.removeFunc(func(key string) bool {
+		return strings.HasPrefix(key, name+":")
+	})
+}
+
+// listFetched returns when the list of communities was last fetched.
+func (c communityCache) listFetched() time.Time {
+	return time.Unix(0, c.fetched.Load())
+}
+
+// setListFetched records when the list of communities was fetched.
+func (c communityCache) setListFetched(t time.Time) {
+	c.fetched.Store(t.UnixNano())
+}
+
+// getPage gets a page of posts within a community.
+func (c communityCache) getPage(name string, num int, sort hb.SortType) (Page, bool) {
+	key := name + ":" + strconv.Itoa(num) + ":" + string(sort)
+	return c.pages.get(key)
+}
+
+// setPage stores a page of posts within a community.
+func (c communityCache) setPage(name string, num int, sort hb.SortType, page Page) {
+	key := name + ":" + strconv.Itoa(num) + ":" + string(sort)
+	c.pages.set(key, page)
 }
 
 type postCache struct {
-	mutex *sync.RWMutex
-	cache map[int]Post
+	cache store[int, Post]
 }
 
-func newPostCache() postCache {
+func newPostCache(s store[int, Post]) postCache {
 	var c postCache
-	c.mutex = new(sync.RWMutex)
-	c.cache = make(map[int]Post)
+	c.cache = s
 	return c
 }
 
 func (c postCache) get(id int) (Post, bool) {
-	c.mutex.RLock()
-	post, ok := c.cache[id]
-	c.mutex.RUnlock()
-	return post, ok
+	return c.cache.get(id)
 }
 
 func (c postCache) set(id int, post Post) {
-	c.mutex.Lock()
-	c.cache[id] = post
-	c.mutex.Unlock()
+	c.cache.set(id, post)
 }
 
 type commentCache struct {
-	mutex *sync.RWMutex
-	cache map[string]PostComments
+	cache store[string, PostComments]
+
+	// mutex is held while storing comments so that pages of comments fetched
+	// concurrently are not lost.
+	mutex *sync.Mutex
 }
 
-func newCommentCache() commentCache {
+func newCommentCache(s store[string, PostComments]) commentCache {
 	var c commentCache
-	c.mutex = new(sync.RWMutex)
-	c.cache = make(map[string]PostComments)
+	c.cache = s
+	c.mutex = new(sync.Mutex)
 	return c
 }
 
 func (c commentCache) get(id int, sort hb.CommentSortType) (PostComments, bool) {
-	c.mutex.RLock()
 	key := strconv.Itoa(id) + ":" + string(sort)
-	comments, ok := c.cache[key]
-	c.mutex.RUnlock()
-	return comments, ok
+	return c.cache.get(key)
+}
+
+// replace stores the result of fn as the comments for a post. fn is given the
+// cached comments, if there are any.
+func (c commentCache) replace(
+	id int,
+	sort hb.CommentSortType,
+	fn func(PostComments, bool) PostComments,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := strconv.Itoa(id) + ":" + string(sort)
+	comments, ok := c.cache.get(key)
+	c.cache.set(key, fn(comments, ok))
 }
 
-func (c commentCache) set(id int, sort hb.CommentSortType, comments PostComments) {
+// update replaces the cached comments for a post with the result of fn. Nothing
+// is done if there are no cached comments.
+func (c commentCache) update(
+	id int,
+	sort hb.CommentSortType,
+	fn func(PostComments) PostComments,
+) {
 	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	key := strconv.Itoa(id) + ":" + string(sort)
-	c.cache[key] = comments
-	c.mutex.Unlock()
+	comments, ok := c.cache.get(key)
+	if !ok {
+		return
+	}
+	c.cache.set(key, fn(comments))
 }
 
 type personCache struct {
-	mutex *sync.RWMutex
-	cache map[string]Person
+	cache store[string, Person]
 }
 
-func newPersonCache() personCache {
+func newPersonCache(s store[string, Person]) personCache {
 	var c personCache
-	c.mutex = new(sync.RWMutex)
-	c.cache = make(map[string]Person)
+	c.cache = s
 	return c
 }
 
 func (c personCache) get(name string) (Person, bool) {
-	c.mutex.RLock()
-	persons, ok := c.cache[name]
-	c.mutex.RUnlock()
-	return persons, ok
+	return c.cache.get(name)
 }
 
 func (c personCache) set(name string, persons Person) {
-	c.mutex.Lock()
-	c.cache[name] = persons
-	c.mutex.Unlock()
+	c.cache.set(name, persons)
 }
 
 // Initialize the cache and populate the communities and home page.
+// If a snapshot exists it's loaded first, in which case failing to reach
+// hexbear is logged rather than returned since the snapshot can be served.
 func Initialize(
 	cli *hb.Client,
 	infoLog *log.Logger,
@@ -187,34 +365,285 @@ func Initialize(
 	markdown goldmark.Markdown,
 	emojiReplacer *strings.Replacer,
 	linkReplacer *strings.Replacer,
+	opts Options,
 ) (*Cache, error) {
 	c := new(Cache)
 	c.infoLog = infoLog
 	c.errLog = errLog
+	c.cli = cli
+	c.Reload(opts)
+	c.postsPerPage = opts.PostsPerPage
+	if c.postsPerPage <= 0 || c.postsPerPage > POSTS_PER_PAGE {
+		c.postsPerPage = POSTS_PER_PAGE
+	}
+	c.listingType = opts.ListingType
+	if c.listingType == "" {
+		c.listingType = hb.ListingTypeLocal
+	}
+	c.host = opts.Host
+	c.snapshotPath = opts.SnapshotPath
+	c.backgroundTimeout = opts.BackgroundTimeout
 
-	c.home = newHomeCache()
-	c.communities = newCommunityCache()
-	c.posts = newPostCache()
-	c.comments = newCommentCache()
-	c.persons = newPersonCache()
+	err := c.openStores(opts)
+	if err != nil {
+		return nil, err
+	}
+	c.flights = newFlight()
+	c.hits = newHits()
+	c.done = make(chan struct{})
 
 	c.markdown = markdown
 	c.emojiReplacer = emojiReplacer
 	c.linkReplacer = linkReplacer
 
-	err := c.fetchCommunities(cli)
+	loaded, err := c.load()
 	if err != nil {
-		return nil, err
+		c.errLog.Println(err)
 	}
 
-	err = c.fetchHome(cli, 1, hb.SortTypeActive)
+	ctx, cancel := context.WithTimeout(context.Background(), c.backgroundTimeout)
+	defer cancel()
+	err = c.fetchCommunities(ctx, cli)
+	if err == nil {
+		err = c.fetchHome(ctx, cli, 1, hb.SortTypeActive)
+	}
 	if err != nil {
-		return nil, err
+		if !loaded {
+			return nil, err
+		}
+		c.errLog.Println("serving snapshot after failing to populate cache:", err)
 	}
 
+	c.goBackground(func() { c.janitor(JANITOR_INTERVAL) })
+	if c.snapshotPath != "" && opts.SnapshotInterval > 0 {
+		c.goBackground(func() { c.snapshotter(opts.SnapshotInterval) })
+	}
+	if opts.RefreshBudget > 0 && opts.RefreshInterval > 0 {
+		c.goBackground(func() {
+			c.scheduler(opts.RefreshInterval, opts.RefreshBudget)
+		})
+	}
 	return c, nil
 }
 
+// Host returns the hostname of the cached instance without a leading www.
+func (c *Cache) Host() string {
+	return c.host
+}
+
+// Close stops the cache's background work and saves the snapshot. Fetches
+// already running in the background are waited on until ctx is done, in which
+// case the snapshot is still saved and the context's error is returned.
+func (c *Cache) Close(ctx context.Context) error {
+	c.closing.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	c.closing.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.background.Wait()
+		close(stopped)
+	}()
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = fmt.Errorf("stopped waiting on background fetches: %w", ctx.Err())
+	}
+	return errors.Join(err, c.Save())
+}
+
+// goBackground runs fn in a new goroutine which Close waits on. Once the
+// cache is closed fn is not run and false is returned.
+func (c *Cache) goBackground(fn func()) bool {
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		fn()
+	}()
+	return true
+}
+
+// ttls are how long each part of the cache is served.
+type ttls struct {
+	page      time.Duration
+	post      time.Duration
+	person    time.Duration
+	search    time.Duration
+	community time.Duration
+	maxStale  time.Duration
+}
+
+// ttl returns how long each part of the cache is served.
+func (c *Cache) ttl() *ttls {
+	return c.ttls.Load()
+}
+
+// Reload applies the options which can safely change while the cache is in
+// use: MaxStale and each of the TTLs. The rest are ignored.
+func (c *Cache) Reload(opts Options) {
+	orDefault := func(d, def time.Duration) time.Duration {
+		if d <= 0 {
+			return def
+		}
+		return d
+	}
+	c.ttls.Store(&ttls{
+		page:      orDefault(opts.PageTTL, PAGE_TTL),
+		post:      orDefault(opts.PostTTL, POST_TTL),
+		person:    orDefault(opts.PersonTTL, PERSON_TTL),
+		search:    orDefault(opts.SearchTTL, SEARCH_TTL),
+		community: orDefault(opts.CommunityTTL, COMMUNITY_TTL),
+		maxStale:  orDefault(opts.MaxStale, MAX_STALE),
+	})
+}
+
+// openStores creates the storage for each part of the cache.
+func (c *Cache) openStores(opts Options) error {
+	home, err := newStore[string, Page](opts, c.errLog, "home", opts.MaxPages)
+	if err != nil {
+		return err
+	}
+	communities, err := newStore[string, Community](
+		opts,
+		c.errLog,
+		"communities",
+		0,
+	)
+	if err != nil {
+		return err
+	}
+	communityPages, err := newStore[string, Page](
+		opts,
+		c.errLog,
+		"community_pages",
+		opts.MaxPages,
+	)
+	if err != nil {
+		return err
+	}
+	posts, err := newStore[int, Post](opts, c.errLog, "posts", opts.MaxPosts)
+	if err != nil {
+		return err
+	}
+	comments, err := newStore[string, PostComments](
+		opts,
+		c.errLog,
+		"comments",
+		opts.MaxComments,
+	)
+	if err != nil {
+		return err
+	}
+	persons, err := newStore[string, Person](
+		opts,
+		c.errLog,
+		"persons",
+		opts.MaxPersons,
+	)
+	if err != nil {
+		return err
+	}
+
+	searches, err := newStore[string, SearchResults](
+		opts,
+		c.errLog,
+		"searches",
+		opts.MaxSearches,
+	)
+	if err != nil {
+		return err
+	}
+
+	c.home = newHomeCache(home)
+	c.communities = newCommunityCache(communities, communityPages)
+	c.posts = newPostCache(posts)
+	c.comments = newCommentCache(comments)
+	c.persons = newPersonCache(persons)
+	c.searches = searches
+	c.commentRefs = newLRU[int, commentRef](MAX_COMMENT_REFS)
+	return nil
+}
+
+// janitor periodically removes data which is too old to be served until the
+// cache is closed.
+func (c *Cache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		ttl := c.ttl()
+		n := c.home.cache.removeOlder(max(ttl.page, ttl.maxStale))
+		n += c.communities.pages.removeOlder(max(ttl.page, ttl.maxStale))
+		n += c.posts.cache.removeOlder(max(ttl.post, ttl.maxStale))
+		n += c.comments.cache.removeOlder(max(ttl.post, ttl.maxStale))
+		n += c.persons.cache.removeOlder(max(ttl.person, ttl.maxStale))
+		n += c.searches.removeOlder(max(ttl.search, ttl.maxStale))
+		if n > 0 {
+			c.infoLog.Println("removed expired cache entries:", n)
+		}
+	}
+}
+
+// freshness describes whether cached data can be served.
+type freshness int
+
+const (
+	// missing data is not cached or too old to be served.
+	missing freshness = iota
+	// stale data has expired, but can be served while it's refreshed.
+	stale
+	// fresh data has not expired.
+	fresh
+)
+
+// freshness returns the freshness of cached data which was fetched at a given
+// time and expires after ttl. The ok argument is whether the data was found
+// in the cache at all.
+func (c *Cache) freshness(ok bool, fetched time.Time, ttl time.Duration) freshness {
+	switch {
+	case !ok:
+		return missing
+	case !expired(fetched, ttl):
+		return fresh
+	case !expired(fetched, c.ttl().maxStale):
+		return stale
+	default:
+		return missing
+	}
+}
+
+// revalidate runs a fetch in the background to replace stale data, unless
+// one is already running for the same key.
+func (c *Cache) revalidate(key string, fetch func(context.Context) error) {
+	if c.flights.running(key) {
+		return
+	}
+	c.goBackground(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			c.backgroundTimeout,
+		)
+		defer cancel()
+		err := c.flights.do(ctx, key, fetch)
+		if err != nil {
+			c.errLog.Println("failed refreshing stale", key, err)
+		}
+	})
+}
+
 // expired returns if a time is older than the duration.
 func expired(t time.Time, d time.Duration) bool {
 	return time.Since(t) > d
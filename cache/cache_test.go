@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadDefaults(t *testing.T) {
+	c := new(Cache)
+	c.Reload(Options{})
+	want := ttls{
+		page:      PAGE_TTL,
+		post:      POST_TTL,
+		person:    PERSON_TTL,
+		search:    SEARCH_TTL,
+		community: COMMUNITY_TTL,
+		maxStale:  MAX_STALE,
+	}
+	if got := *c.ttl(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	c.Reload(Options{CommunityTTL: time.Minute, MaxStale: time.Hour})
+	if got := c.ttl(); got.community != time.Minute || got.maxStale != time.Hour {
+		t.Errorf("got %+v, want the configured community TTL and max stale", *got)
+	}
+}
+
+func TestHostedImage(t *testing.T) {
+	c := &Cache{host: "hexbear.net"}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://hexbear.net/pictrs/image/a.png", true},
+		{"https://www.hexbear.net/pictrs/image/a.png", true},
+		{"https://hexbear.net/post/1", false},
+		{"https://lemmy.ml/pictrs/image/a.png", false},
+		{"https://hexbear.net.example/pictrs/image/a.png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := c.hostedImage(tt.url); got != tt.want {
+			t.Errorf("hostedImage(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
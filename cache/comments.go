@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -12,17 +13,49 @@ import (
 	"git.sr.ht/~kota/hex/hb"
 )
 
+const (
+	// COMMENTS_PER_PAGE is how many comments are fetched for each page after
+	// the first. 50 seems to be the max we can request.
+	COMMENTS_PER_PAGE = 50
+
+	// COMMENT_FETCH_DEPTH is how deeply nested replies are fetched along with
+	// the comment they're replying to. Deeper replies are fetched on demand.
+	COMMENT_FETCH_DEPTH = 8
+
+	// COMMENT_TREE_LIMIT is how many comments lemmy returns when they're
+	// requested as a tree. It ignores the page and limit in that case.
+	COMMENT_TREE_LIMIT = 300
+
+	// MAX_COMMENT_FETCHES limits how many further pages of comments are
+	// fetched while serving a single request. Any more are left for later
+	// requests.
+	MAX_COMMENT_FETCHES = 3
+)
+
 type Comment struct {
 	ID        int `json:"id"`
+	PostID    int `json:"post_id"`
 	Content   template.HTML
 	Published time.Time  `json:"published"`
 	Updated   *time.Time `json:"updated"`
 	Path      string     `json:"path"`
 
+	ContentMarkdown    string // Content before it was rendered.
 	CreatorDisplayName string
 	CreatorURL         string
 	Upvotes            int
+	ChildCount         int // Every reply, including those not loaded.
 	Children           []*Comment
+
+	// Missing is set on stubs standing in for a parent comment which was not
+	// loaded. Only the ID, Path, and Children are set on a stub.
+	Missing bool
+
+	// Highlighted is set on the comment a thread was requested for.
+	Highlighted bool
+
+	// MoreReplies is set to the number of replies left out by Limit.
+	MoreReplies int
 }
 
 type Comments []*Comment
@@ -30,182 +63,721 @@ type Comments []*Comment
 type PostComments struct {
 	Fetched  time.Time
 	Comments Comments
+
+	// Pages is how many pages of COMMENTS_PER_PAGE comments, in lemmy's flat
+	// listing of every comment, are loaded and Complete is set once there
+	// are no more of them. The first fetch is a tree of up to
+	// COMMENT_TREE_LIMIT comments which is counted as the whole pages it
+	// fills, and each fetch after it is the next page of the flat listing.
+	Pages    int
+	Complete bool
+
+	// Stale is set when the comments have expired and are being refreshed.
+	Stale bool
+}
+
+// Page returns the top level comments on a page of them, top to a page and
+// counting from 1, and whether there are more after it.
+func (pc PostComments) Page(n int, top int) (Comments, bool) {
+	start := min((n-1)*top, len(pc.Comments))
+	end := min(start+top, len(pc.Comments))
+	return pc.Comments[start:end], end < len(pc.Comments) || !pc.Complete
 }
 
-// Comments returns the comments associated with a given post.
+// Comments returns the comments associated with a given post, loading more
+// pages of comments until there are at least roots top level comments, the
+// post has no more, or MAX_COMMENT_FETCHES pages have been fetched. Replies
+// are only loaded up to COMMENT_FETCH_DEPTH.
 // The cached version is returned if it exists and has not expired, otherwise,
-// they are fetched.
+// they are fetched. Stale comments are returned while being refreshed in the
+// background.
 //
 // The post in question is looked up in order to retrieve the post's creator
 // and be able to correctly mark comments as being created by the OP.
 func (c *Cache) Comments(
+	ctx context.Context,
 	cli *hb.Client,
 	postID int,
 	sort hb.CommentSortType,
+	roots int,
 ) (PostComments, error) {
 	var comments PostComments
-	post, err := c.Post(cli, postID)
+	post, err := c.Post(ctx, cli, postID)
 	if err != nil {
 		return comments, err
 	}
 
+	key := commentsKey(postID, sort)
+	fetch := func(ctx context.Context) error {
+		return c.fetchComments(ctx, cli, postID, sort, post.CreatorID)
+	}
+
 	comments, ok := c.comments.get(postID, sort)
-	if !ok || expired(comments.Fetched, POST_TTL) {
-		err := c.fetchComments(cli, postID, sort, post.CreatorID)
+	switch c.freshness(ok, comments.Fetched, c.ttl().post) {
+	case stale:
+		c.revalidate(key, fetch)
+		comments.Stale = true
+	case missing:
+		err = c.flights.do(ctx, key, fetch)
 		if err != nil {
 			return comments, err
 		}
 		comments, _ = c.comments.get(postID, sort)
 	}
 
+	for fetches := 0; fetches < MAX_COMMENT_FETCHES; fetches++ {
+		if len(comments.Comments) >= roots || comments.Complete {
+			break
+		}
+		page := comments.Pages + 1
+		err := c.flights.do(
+			ctx,
+			commentsPageKey(postID, sort, page),
+			func(ctx context.Context) error {
+				return c.fetchCommentsPage(
+					ctx,
+					cli,
+					postID,
+					sort,
+					page,
+					post.CreatorID,
+				)
+			},
+		)
+		if err != nil {
+			return comments, err
+		}
+
+		more, ok := c.comments.get(postID, sort)
+		if !ok || more.Pages < page {
+			// Evicted or replaced while fetching.
+			break
+		}
+		more.Stale = comments.Stale
+		comments = more
+	}
 	return comments, nil
 }
 
-// fetchComments retrieves all comments for a post making as many requests as
-// needed.
+// fetchComments retrieves the first page of comments for a post. Any cached
+// comments which aren't too old to serve are refreshed rather than replaced,
+// keeping the later pages and replies which were loaded on demand.
 // The creatorID is used to mark the creator as OP in their comments.
 func (c *Cache) fetchComments(
+	ctx context.Context,
 	cli *hb.Client,
 	postID int,
 	sort hb.CommentSortType,
 	postCreatorID int,
 ) error {
 	c.infoLog.Println("fetching comments for post:", postID)
+	all, err := c.fetchCommentList(
+		ctx,
+		cli,
+		postID,
+		sort,
+		0,
+		0,
+		COMMENT_FETCH_DEPTH,
+		postCreatorID,
+	)
+	if err != nil {
+		return err
+	}
+
+	fetched := PostComments{
+		Fetched:  time.Now(),
+		Pages:    len(all) / COMMENTS_PER_PAGE,
+		Complete: len(all) < COMMENT_TREE_LIMIT,
+	}
+	c.comments.replace(postID, sort, func(cached PostComments, ok bool) PostComments {
+		var orphans []int
+		if ok && !expired(cached.Fetched, c.ttl().maxStale) {
+			fetched.Comments, orphans = refresh(cached.Comments, all)
+			if cached.Pages > fetched.Pages {
+				fetched.Pages = cached.Pages
+				fetched.Complete = cached.Complete
+			}
+		} else {
+			fetched.Comments, orphans = tree(all)
+		}
+		c.logOrphans(postID, orphans)
+		return fetched
+	})
+	return nil
+}
+
+// fetchCommentsPage retrieves a further page of comments for a post and adds
+// them to those which are cached. Nothing is fetched if the first page is not
+// cached.
+//
+// Lemmy can only page through comments as a flat list, so later pages are
+// COMMENTS_PER_PAGE comments of any depth, continuing after as many comments
+// as were loaded before. Those already loaded are replaced, and replies whose
+// parent isn't loaded yet are placed under a stub.
+func (c *Cache) fetchCommentsPage(
+	ctx context.Context,
+	cli *hb.Client,
+	postID int,
+	sort hb.CommentSortType,
+	page int,
+	postCreatorID int,
+) error {
+	if comments, ok := c.comments.get(postID, sort); !ok ||
+		comments.Pages >= page {
+		return nil
+	}
+
+	c.infoLog.Printf("fetching comments page %v for post: %v\n", page, postID)
+	all, err := c.fetchCommentList(
+		ctx,
+		cli,
+		postID,
+		sort,
+		page,
+		0,
+		0,
+		postCreatorID,
+	)
+	if err != nil {
+		return err
+	}
+
+	c.comments.update(postID, sort, func(comments PostComments) PostComments {
+		if comments.Pages != page-1 {
+			return comments // Replaced while fetching.
+		}
+		var orphans []int
+		comments.Comments, orphans = merge(comments.Comments, all)
+		comments.Pages = page
+		comments.Complete = len(all) < COMMENTS_PER_PAGE
+		c.logOrphans(postID, orphans)
+		return comments
+	})
+	return nil
+}
+
+// fetchBranch retrieves a comment along with its replies up to depth levels
+// deep and adds them to the comments which are cached for the post.
+func (c *Cache) fetchBranch(
+	ctx context.Context,
+	cli *hb.Client,
+	postID int,
+	sort hb.CommentSortType,
+	parentID int,
+	depth int,
+	postCreatorID int,
+) error {
+	c.infoLog.Printf("fetching replies to comment %v on post: %v\n", parentID, postID)
+	all, err := c.fetchCommentList(
+		ctx,
+		cli,
+		postID,
+		sort,
+		0,
+		parentID,
+		depth,
+		postCreatorID,
+	)
+	if err != nil {
+		return err
+	}
+
+	c.comments.update(postID, sort, func(comments PostComments) PostComments {
+		var orphans []int
+		comments.Comments, orphans = merge(comments.Comments, all)
+		c.logOrphans(postID, orphans)
+		return comments
+	})
+	return nil
+}
+
+// fetchCommentList makes a single request for comments on a post and returns
+// them in a flat list. With a depth the comments are requested as a tree,
+// otherwise a page of COMMENTS_PER_PAGE of them is requested.
+func (c *Cache) fetchCommentList(
+	ctx context.Context,
+	cli *hb.Client,
+	postID int,
+	sort hb.CommentSortType,
+	page int,
+	parentID int,
+	depth int,
+	postCreatorID int,
+) (Comments, error) {
+	limit := 0
+	if depth == 0 {
+		limit = COMMENTS_PER_PAGE
+	}
+	views, _, err := cli.CommentList(
+		ctx,
+		page,
+		limit,
+		postID,
+		parentID,
+		depth,
+		sort,
+		hb.ListingTypeAll,
+	)
+	if err != nil || views == nil {
+		return nil, upstreamError(
+			fmt.Sprintf("failed fetching comments for post %v", postID),
+			err,
+		)
+	}
+
 	var all Comments
-	page := 1
-	limit := 50 // 50 seems to be the max we can request.
-	for {
-		views, resp, err := cli.CommentList(
-			context.Background(),
-			page,
-			limit,
+	for _, view := range views.Comments {
+		comment, err := c.newComment(view, postCreatorID)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, comment)
+	}
+	return all, nil
+}
+
+// newComment converts an hb.CommentView into a Comment without any children.
+// The creatorID is used to mark the creator of the post as OP.
+func (c *Cache) newComment(
+	view hb.CommentView,
+	postCreatorID int,
+) (*Comment, error) {
+	content, err := c.processMarkdown(view.Comment.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	c.commentRefs.set(view.Comment.ID, commentRef{
+		PostID: view.Comment.PostID,
+		Path:   view.Comment.Path,
+	})
+	return &Comment{
+		ID:        view.Comment.ID,
+		PostID:    view.Comment.PostID,
+		Content:   content,
+		Path:      view.Comment.Path,
+		Published: view.Comment.Published,
+		Updated:   view.Comment.Updated,
+
+		ContentMarkdown: view.Comment.Content,
+		CreatorDisplayName: processPersonName(
+			view.Creator,
+			view.CreatorIsAdmin,
+			view.CreatorIsModerator,
+			postCreatorID == view.Creator.ID,
+		),
+		CreatorURL: processPersonURL(view.Creator),
+		Upvotes:    view.Counts.Upvotes,
+		ChildCount: view.Counts.ChildCount,
+	}, nil
+}
+
+// logOrphans logs comments which were placed without their parent.
+func (c *Cache) logOrphans(postID int, orphans []int) {
+	if len(orphans) > 0 {
+		c.infoLog.Printf(
+			"post %v has comments without a loaded parent: %v\n",
 			postID,
-			sort,
+			orphans,
 		)
-		if err != nil || views == nil {
-			return fmt.Errorf(
-				"failed fetching comments for post %v: %v resp: %v",
-				postID,
-				err,
-				resp,
-			)
-		}
-		if len(views.Comments) == 0 {
-			break
+	}
+}
+
+// merge returns a new tree with the fetched comments added to an existing
+// tree. Fetched comments replace existing ones with the same ID, and stubs
+// are replaced by the comments they stood in for. The existing tree is not
+// modified since it may be in use.
+func merge(existing Comments, fetched Comments) (Comments, []int) {
+	byID := make(map[int]*Comment, len(fetched))
+	for _, comment := range fetched {
+		byID[comment.ID] = comment
+	}
+
+	var all Comments
+	for _, comment := range flatten(existing) {
+		if f, ok := byID[comment.ID]; ok {
+			all = append(all, f)
+			delete(byID, comment.ID)
+		} else {
+			all = append(all, comment)
+		}
+	}
+	for _, comment := range fetched {
+		if _, ok := byID[comment.ID]; ok {
+			all = append(all, comment)
+		}
+	}
+	return tree(all)
+}
+
+// refresh returns a new tree of freshly fetched comments followed by those in
+// an existing tree which weren't fetched again, such as later pages and
+// replies loaded on demand. Unlike merge the fetched comments keep their own
+// order. The existing tree is not modified since it may be in use.
+func refresh(existing Comments, fetched Comments) (Comments, []int) {
+	ids := make(map[int]bool, len(fetched))
+	for _, comment := range fetched {
+		ids[comment.ID] = true
+	}
+
+	all := slices.Clone(fetched)
+	for _, comment := range flatten(existing) {
+		if !ids[comment.ID] {
+			all = append(all, comment)
 		}
+	}
+	return tree(all)
+}
 
-		for _, view := range views.Comments {
-			content, err := c.processMarkdown(view.Comment.Content)
-			if err != nil {
-				return err
+// flatten returns copies of the comments in a tree without their children, in
+// the order they're shown. Stubs are left out.
+func flatten(cs Comments) Comments {
+	var all Comments
+	var walk func(Comments)
+	walk = func(cs Comments) {
+		for _, comment := range cs {
+			if !comment.Missing {
+				cp := *comment
+				cp.Children = nil
+				all = append(all, &cp)
 			}
+			walk(comment.Children)
+		}
+	}
+	walk(cs)
+	return all
+}
 
-			all = append(all, &Comment{
-				ID:        view.Comment.ID,
-				Content:   content,
-				Path:      view.Comment.Path,
-				Published: view.Comment.Published,
-				Updated:   view.Comment.Updated,
-
-				CreatorDisplayName: processPersonName(
-					view.Creator,
-					view.CreatorIsAdmin,
-					view.CreatorIsModerator,
-					postCreatorID == view.Creator.ID,
-				),
-				CreatorURL: processPersonURL(view.Creator),
-				Upvotes:    view.Counts.Upvotes,
-			})
-		}
-		if len(views.Comments) < limit {
-			break
+// Thread returns a single comment along with its ancestors and replies. The
+// returned comments are the chain of ancestors from the top level comment
+// down to the requested one, which has all of its replies and is marked as
+// highlighted. ErrNotFound is returned if the comment is not on the post.
+//
+// If the comment, or its replies, have not been loaded yet they are fetched
+// and added to the post's cached comments.
+func (c *Cache) Thread(
+	ctx context.Context,
+	cli *hb.Client,
+	postID int,
+	commentID int,
+	sort hb.CommentSortType,
+) (PostComments, error) {
+	comments, err := c.Comments(ctx, cli, postID, sort, 0)
+	if err != nil {
+		return comments, err
+	}
+	find := func() Comments {
+		return findComment(comments.Comments, func(comment *Comment) bool {
+			return comment.ID == commentID && !comment.Missing
+		})
+	}
+	notFound := fmt.Errorf(
+		"comment %v on post %v: %w",
+		commentID,
+		postID,
+		ErrNotFound,
+	)
+
+	// Either the whole branch the comment is on, or just its replies, is
+	// fetched if needed.
+	var parentID, depth int
+	chain := find()
+	if chain == nil {
+		ref, err := c.commentRef(ctx, cli, commentID)
+		if err != nil {
+			return comments, err
 		}
-		page += 1
+		ids, ok := parsePath(ref.Path)
+		if ref.PostID != postID || !ok {
+			return comments, notFound
+		}
+		parentID = ids[0]
+		depth = len(ids) - 1 + COMMENT_FETCH_DEPTH
+	} else if comment := chain[len(chain)-1]; comment.ChildCount > 0 &&
+		len(comment.Children) == 0 {
+		parentID = commentID
+		depth = COMMENT_FETCH_DEPTH
+	}
+	if parentID != 0 {
+		post, err := c.Post(ctx, cli, postID)
+		if err != nil {
+			return comments, err
+		}
+		err = c.flights.do(
+			ctx,
+			branchKey(postID, parentID, sort),
+			func(ctx context.Context) error {
+				return c.fetchBranch(
+					ctx,
+					cli,
+					postID,
+					sort,
+					parentID,
+					depth,
+					post.CreatorID,
+				)
+			},
+		)
+		if err != nil {
+			return comments, err
+		}
+		if more, ok := c.comments.get(postID, sort); ok {
+			more.Stale = comments.Stale
+			comments = more
+		}
+		chain = find()
+	}
+	if chain == nil {
+		return comments, notFound
 	}
 
-	c.comments.set(postID, sort, PostComments{
-		Fetched:  time.Now(),
-		Comments: tree(all),
-	})
+	// The cached comments are shared so the chain is copied before trimming
+	// each ancestor down to the one child leading to the comment.
+	var root *Comment
+	var parent *Comment
+	for i, comment := range chain {
+		cp := *comment
+		if i == len(chain)-1 {
+			cp.Highlighted = true
+		} else {
+			cp.Children = nil
+		}
+		if parent == nil {
+			root = &cp
+		} else {
+			parent.Children = []*Comment{&cp}
+		}
+		parent = &cp
+	}
+	comments.Comments = Comments{root}
+	// A thread has no further pages, even if the post does.
+	comments.Complete = true
+	return comments, nil
+}
+
+// findComment returns the path of comments from the top level down to the
+// first comment which matches or nil if none of them do.
+func findComment(comments Comments, match func(*Comment) bool) Comments {
+	for _, comment := range comments {
+		if match(comment) {
+			return Comments{comment}
+		}
+		if chain := findComment(comment.Children, match); chain != nil {
+			return append(Comments{comment}, chain...)
+		}
+	}
 	return nil
 }
 
-func tree(all Comments) Comments {
-	root := new(Comment)
-	root.addAll(all, 1)
+// Limit returns a copy of the comments with replies nested deeper than depth
+// left out. Comments whose replies were left out have MoreReplies set. In a
+// thread the depth is counted from the highlighted comment, so its ancestors
+// are always kept.
+func (cs Comments) Limit(depth int) Comments {
+	chain := findComment(cs, func(comment *Comment) bool {
+		return comment.Highlighted
+	})
+	ancestors := make(map[*Comment]bool, len(chain))
+	for _, comment := range chain {
+		if !comment.Highlighted {
+			ancestors[comment] = true
+		}
+	}
+	return limit(cs, depth, ancestors)
+}
 
-	// Return a slice of comments instead of a root node.
-	var roots Comments
-	for _, child := range root.Children {
-		roots = append(roots, child)
+func limit(cs Comments, depth int, ancestors map[*Comment]bool) Comments {
+	limited := make(Comments, 0, len(cs))
+	for _, comment := range cs {
+		cp := *comment
+		switch {
+		case ancestors[comment]:
+			cp.Children = limit(comment.Children, depth, ancestors)
+		case depth <= 1 || len(comment.Children) == 0:
+			cp.Children = nil
+			if len(comment.Children) > 0 || comment.ChildCount > 0 {
+				cp.MoreReplies = max(comment.ChildCount, comment.replies())
+			}
+		default:
+			cp.Children = limit(comment.Children, depth-1, ancestors)
+		}
+		limited = append(limited, &cp)
 	}
-	return roots
+	return limited
 }
 
-// addAll attempts to recursively all given child comments to the parent comment.
-//
-// The list is not sorted by parents, instead, any children which were not
-// added in the first round are repeated until they can be added.
-// This _could_ take a very long time in theory, but in practice it normally
-// takes 1-5 iterations with each iteration being smaller than the previous.
-//
-// If more than 50 iterations would take place the process is cancelled and
-// whatever remaining problem comments are dropped. These comments probably did
-// not have a parent.
+// replies counts the loaded replies to a comment, including nested ones.
+func (c *Comment) replies() int {
+	n := len(c.Children)
+	for _, child := range c.Children {
+		n += child.replies()
+	}
+	return n
+}
+
+// commentRef locates a comment.
+type commentRef struct {
+	PostID int
+	Path   string
+}
+
+// CommentPost returns the ID of the post a comment was made on.
+func (c *Cache) CommentPost(
+	ctx context.Context,
+	cli *hb.Client,
+	id int,
+) (int, error) {
+	ref, err := c.commentRef(ctx, cli, id)
+	return ref.PostID, err
+}
+
+// commentRef returns the post a comment was made on and its path. Since a
+// comment can't move, the result is remembered for as long as there's room.
+func (c *Cache) commentRef(
+	ctx context.Context,
+	cli *hb.Client,
+	id int,
+) (commentRef, error) {
+	if ref, ok := c.commentRefs.get(id); ok {
+		return ref, nil
+	}
+
+	key := "comment:" + strconv.Itoa(id)
+	err := c.flights.do(ctx, key, func(ctx context.Context) error {
+		return c.fetchCommentRef(ctx, cli, id)
+	})
+	if err != nil {
+		return commentRef{}, err
+	}
+	ref, _ := c.commentRefs.get(id)
+	return ref, nil
+}
+
+// fetchCommentRef looks up which post a comment was made on.
+func (c *Cache) fetchCommentRef(
+	ctx context.Context,
+	cli *hb.Client,
+	id int,
+) error {
+	c.infoLog.Println("fetching comment:", id)
+
+	cr, _, err := cli.Comment(ctx, id)
+	if err != nil || cr == nil {
+		return upstreamError(fmt.Sprintf("failed fetching comment %v", id), err)
+	}
+	c.commentRefs.set(id, commentRef{
+		PostID: cr.CommentView.Comment.PostID,
+		Path:   cr.CommentView.Comment.Path,
+	})
+	return nil
+}
+
+// tree builds a tree from a flat list of comments and returns the top level
+// comments. Siblings are kept in the order they were given in.
 //
-// This approach means we do not need to re-sort the comments after insertion.
-func (parent *Comment) addAll(children []*Comment, iteration int) int {
-	// Prevent an out of control stack overflow.
-	if iteration > 50 {
-		return iteration
+// Every comment is indexed by ID first, so each one can be attached to its
+// parent directly regardless of the order they arrive in. Comments whose
+// parent was not given are attached to a stub comment standing in for the
+// missing parent instead of being dropped. Comments with malformed paths are
+// placed at the top level. The IDs of both kinds of orphans are returned.
+func tree(all Comments) (Comments, []int) {
+	byID := make(map[int]*Comment, len(all))
+	for _, comment := range all {
+		if _, ok := byID[comment.ID]; !ok {
+			byID[comment.ID] = comment
+		}
 	}
 
-	var missing []*Comment
-	for _, child := range children {
-		found := parent.addChild(child)
+	root := new(Comment)
+	var orphans []int
+	for _, comment := range all {
+		if byID[comment.ID] != comment {
+			continue // A duplicate, which can happen across pages.
+		}
+
+		ids, ok := parsePath(comment.Path)
+		if !ok || ids[len(ids)-1] != comment.ID {
+			orphans = append(orphans, comment.ID)
+			root.Children = append(root.Children, comment)
+			continue
+		}
+
+		parent, found := parentOf(root, byID, comment.Path, ids)
+		if parent == nil {
+			// The parent's path disagrees with this comment's path.
+			orphans = append(orphans, comment.ID)
+			root.Children = append(root.Children, comment)
+			continue
+		}
 		if !found {
-			missing = append(missing, child)
+			orphans = append(orphans, comment.ID)
 		}
+		parent.Children = append(parent.Children, comment)
 	}
+	return root.Children, orphans
+}
 
-	if len(missing) > 0 {
-		parent.addAll(missing, iteration+1)
+// parentOf returns the parent for a comment with the given path and path IDs.
+// If the parent is not in byID a stub is created for it, and attached to its
+// own parent in turn. Either way found is false if the parent is a stub. A nil
+// parent is returned if the parent's path does not match.
+func parentOf(
+	root *Comment,
+	byID map[int]*Comment,
+	path string,
+	ids []int,
+) (parent *Comment, found bool) {
+	if len(ids) == 1 {
+		return root, true
 	}
-	return iteration
-}
 
-// addChild attempts to add a comment to a tree rooted at parent.
-// The tree will be traversed to find the appropriate parent. The success of
-// this operation is returned: if the parent could be found.
-func (parent *Comment) addChild(child *Comment) bool {
-	var parentID int
-	path := strings.Split(child.Path, ".")
-	if len(path) > 1 {
-		var err error
-		parentID, err = strconv.Atoi(path[len(path)-2])
-		if err != nil {
-			// This should never happen! The comment's path is malformed so we
-			// silently drop the comment returning success.
-			return true
+	parentIDs := ids[:len(ids)-1]
+	parentPath := path[:strings.LastIndexByte(path, '.')]
+	parent, ok := byID[parentIDs[len(parentIDs)-1]]
+	if ok {
+		// Checking the path also rules out cycles since a parent's path is
+		// always shorter than its child's.
+		if parent.Path != parentPath {
+			return nil, true
 		}
+		return parent, !parent.Missing
 	}
 
-	// Is this comment a child of the current parent?
-	if parentID == parent.ID {
-		parent.Children = append(parent.Children, child)
-		return true
+	parent = &Comment{
+		ID:      parentIDs[len(parentIDs)-1],
+		Path:    parentPath,
+		Missing: true,
+	}
+	byID[parent.ID] = parent
+	grandparent, _ := parentOf(root, byID, parentPath, parentIDs)
+	if grandparent == nil {
+		grandparent = root
 	}
+	grandparent.Children = append(grandparent.Children, parent)
+	return parent, false
+}
 
-	// The comment is a child of a different parent.
-	// Recursively call addChild on all siblings.
-	for _, c := range parent.Children {
-		if c.addChild(child) {
-			return true
+// parsePath parses a comment path such as "0.12.345" into the IDs of the
+// comment and its ancestors, excluding the leading 0.
+func parsePath(path string) ([]int, bool) {
+	rest, ok := strings.CutPrefix(path, "0.")
+	if !ok {
+		return nil, false
+	}
+	ids := make([]int, 0, strings.Count(rest, ".")+1)
+	for {
+		part, next, more := strings.Cut(rest, ".")
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, false
 		}
+		ids = append(ids, id)
+		if !more {
+			return ids, true
+		}
+		rest = next
 	}
-
-	// The comment's parent was not found in the tree.
-	return false
 }
 
 func (c *Cache) processMarkdown(s string) (template.HTML, error) {
@@ -0,0 +1,489 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/hex/hb"
+)
+
+// comments creates comments from pairs of IDs and paths.
+func comments(pairs ...any) Comments {
+	var all Comments
+	for i := 0; i < len(pairs); i += 2 {
+		all = append(all, &Comment{
+			ID:   pairs[i].(int),
+			Path: pairs[i+1].(string),
+		})
+	}
+	return all
+}
+
+// formatPath is the inverse of parsePath.
+func formatPath(ids []int) string {
+	var b strings.Builder
+	b.WriteString("0")
+	for _, id := range ids {
+		b.WriteString(".")
+		b.WriteString(strconv.Itoa(id))
+	}
+	return b.String()
+}
+
+// shape describes a tree of comments such as "1(2 3) ?4(5)", where replies
+// are in parentheses and stubs are marked with a question mark.
+func shape(cs Comments) string {
+	var parts []string
+	for _, comment := range cs {
+		s := strconv.Itoa(comment.ID)
+		if comment.Missing {
+			s = "?" + s
+		}
+		if len(comment.Children) > 0 {
+			s += "(" + shape(comment.Children) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestTree(t *testing.T) {
+	tests := []struct {
+		name    string
+		all     Comments
+		shape   string
+		orphans []int
+	}{
+		{
+			name:  "empty",
+			shape: "",
+		},
+		{
+			name: "in order",
+			all: comments(
+				1, "0.1",
+				2, "0.1.2",
+				3, "0.1.2.3",
+				4, "0.4",
+			),
+			shape: "1(2(3)) 4",
+		},
+		{
+			name: "out of order",
+			all: comments(
+				3, "0.1.2.3",
+				4, "0.4",
+				2, "0.1.2",
+				1, "0.1",
+			),
+			shape: "4 1(2(3))",
+		},
+		{
+			name: "sibling order",
+			all: comments(
+				1, "0.1",
+				5, "0.1.5",
+				3, "0.1.3",
+				4, "0.1.4",
+				2, "0.2",
+			),
+			shape: "1(5 3 4) 2",
+		},
+		{
+			name: "orphan",
+			all: comments(
+				3, "0.1.2.3",
+				4, "0.4",
+			),
+			shape:   "?1(?2(3)) 4",
+			orphans: []int{3},
+		},
+		{
+			name: "orphans share a stub",
+			all: comments(
+				2, "0.1.2",
+				3, "0.1.3",
+				5, "0.1.4.5",
+			),
+			shape:   "?1(2 3 ?4(5))",
+			orphans: []int{2, 3, 5},
+		},
+		{
+			name: "orphan under a loaded ancestor",
+			all: comments(
+				1, "0.1",
+				3, "0.1.2.3",
+			),
+			shape:   "1(?2(3))",
+			orphans: []int{3},
+		},
+		{
+			name: "malformed paths",
+			all: comments(
+				1, "",
+				2, "0",
+				3, "1.3",
+				4, "0.a.4",
+				5, "0.-1.5",
+				6, "0.0.6",
+				7, "0.7.",
+				8, "0..8",
+				9, "0.1.2",
+			),
+			shape:   "1 2 3 4 5 6 7 8 9",
+			orphans: []int{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		{
+			name: "self referencing",
+			all: comments(
+				5, "0.5.5",
+				6, "0.6",
+			),
+			shape:   "5 6",
+			orphans: []int{5},
+		},
+		{
+			name: "cycle",
+			all: comments(
+				1, "0.2.1",
+				2, "0.1.2",
+			),
+			shape:   "1 2",
+			orphans: []int{1, 2},
+		},
+		{
+			name: "cycle through a stub",
+			all: comments(
+				5, "0.5.3.5",
+			),
+			shape:   "?3(5)",
+			orphans: []int{5},
+		},
+		{
+			name: "parent path disagrees",
+			all: comments(
+				1, "0.1",
+				2, "0.1.2",
+				3, "0.9.2.3",
+			),
+			shape:   "1(2) 3",
+			orphans: []int{3},
+		},
+		{
+			name: "duplicates",
+			all: comments(
+				1, "0.1",
+				2, "0.1.2",
+				1, "0.1",
+				2, "0.1.2",
+				3, "0.3",
+			),
+			shape: "1(2) 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, orphans := tree(tt.all)
+			if s := shape(got); s != tt.shape {
+				t.Errorf("got tree %q, want %q", s, tt.shape)
+			}
+			if !slices.Equal(orphans, tt.orphans) {
+				t.Errorf("got orphans %v, want %v", orphans, tt.orphans)
+			}
+		})
+	}
+}
+
+func TestTreeDuplicateKeepsFirst(t *testing.T) {
+	first := &Comment{ID: 1, Path: "0.1", Upvotes: 1}
+	second := &Comment{ID: 1, Path: "0.1", Upvotes: 2}
+	got, _ := tree(Comments{first, second})
+	if len(got) != 1 || got[0] != first {
+		t.Errorf("got %v, want only the first comment", shape(got))
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	deep := make([]int, 1000)
+	for i := range deep {
+		deep[i] = i + 1
+	}
+	tests := []struct {
+		path string
+		ids  []int
+		ok   bool
+	}{
+		{path: "0.1", ids: []int{1}, ok: true},
+		{path: "0.1.22.333", ids: []int{1, 22, 333}, ok: true},
+		{path: formatPath(deep), ids: deep, ok: true},
+		{path: ""},
+		{path: "0"},
+		{path: "0."},
+		{path: "1.2"},
+		{path: ".1"},
+		{path: "0.1."},
+		{path: "0..1"},
+		{path: "0.0"},
+		{path: "0.-1"},
+		{path: "0.1.x"},
+		{path: "0.1.99999999999999999999"},
+	}
+	for _, tt := range tests {
+		ids, ok := parsePath(tt.path)
+		if ok != tt.ok || !slices.Equal(ids, tt.ids) {
+			name := tt.path
+			if len(name) > 20 {
+				name = name[:20] + "..."
+			}
+			t.Errorf("parsePath(%q) = %v, %v, want %v, %v", name, ids, ok, tt.ids, tt.ok)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	existing, _ := tree(comments(
+		1, "0.1",
+		3, "0.1.2.3",
+		4, "0.4",
+	))
+	fetched := comments(
+		2, "0.1.2",
+		5, "0.1.2.5",
+		6, "0.6",
+	)
+	got, orphans := merge(existing, fetched)
+	if s, want := shape(got), "1(2(3 5)) 4 6"; s != want {
+		t.Errorf("got tree %q, want %q", s, want)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("got orphans %v, want none", orphans)
+	}
+	if s, want := shape(existing), "1(?2(3)) 4"; s != want {
+		t.Errorf("existing tree was modified to %q, want %q", s, want)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	existing, _ := tree(comments(
+		1, "0.1",
+		2, "0.1.2",
+		3, "0.3",
+		4, "0.3.4",
+		5, "0.5",
+	))
+	fetched := comments(
+		6, "0.6",
+		3, "0.3",
+		1, "0.1",
+	)
+	got, orphans := refresh(existing, fetched)
+	if s, want := shape(got), "6 3(4) 1(2) 5"; s != want {
+		t.Errorf("got tree %q, want %q", s, want)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("got orphans %v, want none", orphans)
+	}
+	if s, want := shape(existing), "1(2) 3(4) 5"; s != want {
+		t.Errorf("existing tree was modified to %q, want %q", s, want)
+	}
+}
+
+// lemmyComments returns a client for a server listing n top level comments on
+// post 1 the way lemmy does, and the list of flat pages requested from it.
+func lemmyComments(t *testing.T, n int) (*hb.Client, func() []int) {
+	var mutex sync.Mutex
+	var pages []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		start, end := 0, min(n, COMMENT_TREE_LIMIT)
+		if q.Get("max_depth") == "" {
+			page, _ := strconv.Atoi(q.Get("page"))
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			start = min((max(page, 1)-1)*limit, n)
+			end = min(start+limit, n)
+			mutex.Lock()
+			pages = append(pages, page)
+			mutex.Unlock()
+		}
+		var resp hb.CommentListResp
+		for id := start + 1; id <= end; id++ {
+			resp.Comments = append(resp.Comments, hb.CommentView{
+				Comment: hb.Comment{
+					ID:     id,
+					PostID: 1,
+					Path:   "0." + strconv.Itoa(id),
+				},
+				Creator: hb.Person{Name: "a", Local: true},
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	cli, err := hb.NewClient(
+		srv.URL+"/api/v3/",
+		log.New(io.Discard, "", 0),
+		hb.WithRateLimit(0, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli, func() []int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requested := pages
+		pages = nil
+		return requested
+	}
+}
+
+func TestCommentsPaging(t *testing.T) {
+	cli, requested := lemmyComments(t, 700)
+	c := newTestCache(t, Options{})
+	c.posts.set(1, Post{ID: 1, Fetched: time.Now()})
+
+	steps := []struct {
+		roots    int
+		pages    []int
+		loaded   int
+		complete bool
+	}{
+		// The first tree of comments covers the first 6 pages.
+		{roots: 20, loaded: 300},
+		{roots: 300, loaded: 300},
+		{roots: 400, pages: []int{7, 8}, loaded: 400},
+		// Only MAX_COMMENT_FETCHES pages are fetched for each request.
+		{roots: 10000, pages: []int{9, 10, 11}, loaded: 550},
+		{roots: 10000, pages: []int{12, 13, 14}, loaded: 700},
+		{roots: 10000, pages: []int{15}, loaded: 700, complete: true},
+		{roots: 10000, loaded: 700, complete: true},
+	}
+	for _, step := range steps {
+		comments, err := c.Comments(
+			context.Background(),
+			cli,
+			1,
+			hb.CommentSortTypeHot,
+			step.roots,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requested(); !slices.Equal(got, step.pages) {
+			t.Errorf("roots %d: requested pages %v, want %v", step.roots, got, step.pages)
+		}
+		if len(comments.Comments) != step.loaded || comments.Complete != step.complete {
+			t.Errorf(
+				"roots %d: got %d comments, complete %v, want %d, %v",
+				step.roots,
+				len(comments.Comments),
+				comments.Complete,
+				step.loaded,
+				step.complete,
+			)
+		}
+		ids := make(map[int]bool)
+		for _, comment := range comments.Comments {
+			if ids[comment.ID] {
+				t.Fatalf("roots %d: comment %d loaded twice", step.roots, comment.ID)
+			}
+			ids[comment.ID] = true
+		}
+	}
+}
+
+// deepThread returns n comments in chains of replies depth comments long.
+func deepThread(n, depth int) Comments {
+	all := make(Comments, 0, n)
+	var ids []int
+	for id := 1; id <= n; id++ {
+		if len(ids) == depth {
+			ids = nil
+		}
+		ids = append(ids, id)
+		all = append(all, &Comment{ID: id, Path: formatPath(ids)})
+	}
+	return all
+}
+
+// wideThread returns n comments which are all replies to one of roots top
+// level comments.
+func wideThread(n, roots int) Comments {
+	all := make(Comments, 0, n)
+	for id := 1; id <= roots; id++ {
+		all = append(all, &Comment{ID: id, Path: formatPath([]int{id})})
+	}
+	for id := roots + 1; id <= n; id++ {
+		parent := id%roots + 1
+		all = append(all, &Comment{ID: id, Path: formatPath([]int{parent, id})})
+	}
+	return all
+}
+
+func BenchmarkTree(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		all  Comments
+	}{
+		{name: "deep", all: deepThread(5000, 500)},
+		{name: "wide", all: wideThread(5000, 50)},
+		{name: "reversed", all: slices.Clone(deepThread(5000, 500))},
+	}
+	slices.Reverse(benchmarks[2].all)
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			all := make(Comments, len(bm.all))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j, comment := range bm.all {
+					cp := *comment
+					all[j] = &cp
+				}
+				b.StartTimer()
+				tree(all)
+			}
+		})
+	}
+}
+
+func TestCommentsRefreshKeepsPages(t *testing.T) {
+	cli, requested := lemmyComments(t, 700)
+	c := newTestCache(t, Options{})
+	c.posts.set(1, Post{ID: 1, Fetched: time.Now()})
+	ctx := context.Background()
+
+	_, err := c.Comments(ctx, cli, 1, hb.CommentSortTypeHot, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested()
+	err = c.fetchComments(ctx, cli, 1, hb.CommentSortTypeHot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := c.Comments(ctx, cli, 1, hb.CommentSortTypeHot, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := requested(); len(got) != 0 {
+		t.Errorf("requested pages %v after a refresh, want none", got)
+	}
+	if len(comments.Comments) != 400 || comments.Pages != 8 {
+		t.Errorf(
+			"got %d comments over %d pages, want 400 over 8",
+			len(comments.Comments),
+			comments.Pages,
+		)
+	}
+}
@@ -3,8 +3,6 @@ package cache
 import (
 	"context"
 	"fmt"
-	"strconv"
-	"sync"
 	"time"
 
 	"git.sr.ht/~kota/hex/hb"
@@ -15,92 +13,100 @@ type Community struct {
 	Name        string `json:"name"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
-
-	// pages contains all the posts on a particular page for a Community.
-	mutex *sync.RWMutex
-	pages map[string]Page
-}
-
-// get attempts to get a page from the mapping of pages in a community.
-func (c Community) get(num int, sort hb.SortType) (Page, bool) {
-	c.mutex.RLock()
-	key := strconv.Itoa(num) + ":" + string(sort)
-	page, ok := c.pages[key]
-	c.mutex.RUnlock()
-	return page, ok
-}
-
-// set attempts to store a page in a community's page mapping.
-func (c Community) set(num int, sort hb.SortType, page Page) {
-	c.mutex.Lock()
-	key := strconv.Itoa(num) + ":" + string(sort)
-	c.pages[key] = page
-	c.mutex.Unlock()
 }
 
 // A Page contains all the posts on a particular page.
 type Page struct {
 	PostIDs []int
 	Fetched time.Time
+
+	// Stale is set when the page has expired and is being refreshed.
+	Stale bool
 }
 
 // Community returns a Community by name.
 // The cached version is returned if it exists, otherwise, all communities are
-// fetched and updated.
+// fetched and updated. If the list of communities has expired it's refreshed
+// in the background.
 // This does not fetch posts within this community.
-func (c *Cache) Community(cli *hb.Client, name string) (Community, error) {
+func (c *Cache) Community(
+	ctx context.Context,
+	cli *hb.Client,
+	name string,
+) (Community, error) {
+	fetch := func(ctx context.Context) error {
+		return c.fetchCommunities(ctx, cli)
+	}
+
 	comm, ok := c.communities.get(name)
 	if ok {
+		if expired(c.communities.listFetched(), c.ttl().community) {
+			c.revalidate("communities", fetch)
+		}
 		return comm, nil
 	}
 
-	err := c.fetchCommunities(cli)
+	err := c.flights.do(ctx, "communities", fetch)
 	comm, ok = c.communities.get(name)
 	if !ok && err == nil {
-		err = fmt.Errorf("community %v does not exist", name)
+		err = fmt.Errorf("community %v: %w", name, ErrNotFound)
 	}
 	return comm, err
 }
 
 // Communities returns a list of all cached communities.
+// If none are cached they are fetched, and if the list has expired it's
+// refreshed in the background.
 // This does not fetch posts within these communities.
-func (c *Cache) Communities() ([]Community, error) {
-	return c.communities.getAll(), nil
+func (c *Cache) Communities(
+	ctx context.Context,
+	cli *hb.Client,
+) ([]Community, error) {
+	fetch := func(ctx context.Context) error {
+		return c.fetchCommunities(ctx, cli)
+	}
+
+	cms := c.communities.getAll()
+	if len(cms) == 0 {
+		err := c.flights.do(ctx, "communities", fetch)
+		return c.communities.getAll(), err
+	}
+	if expired(c.communities.listFetched(), c.ttl().community) {
+		c.revalidate("communities", fetch)
+	}
+	return cms, nil
 }
 
-// fetchCommunities retrieves all local hexbear communities.
+// fetchCommunities retrieves all local hexbear communities and replaces the
+// cached list with them. Communities which no longer exist are removed along
+// with their pages, but the pages of the others are kept.
 // This does not fetch posts within these communities.
-func (c *Cache) fetchCommunities(cli *hb.Client) error {
+func (c *Cache) fetchCommunities(ctx context.Context, cli *hb.Client) error {
 	c.infoLog.Println("fetching communities")
+	now := time.Now()
 
+	var all []Community
 	page := 1
 	limit := 50 // 50 seems to be the max we can request.
 	for {
-		views, resp, err := cli.CommunityList(
-			context.Background(),
+		views, _, err := cli.CommunityList(
+			ctx,
 			page,
 			limit,
 			hb.ListingTypeLocal,
 		)
 		if err != nil || views == nil {
-			return fmt.Errorf(
-				"failing getting communities: %v resp: %v",
-				err,
-				resp,
-			)
+			return upstreamError("failed fetching communities", err)
 		}
 		if len(views.Communities) == 0 {
 			break
 		}
 		for _, view := range views.Communities {
-			c.communities.set(view.Community.Name, Community{
+			all = append(all, Community{
 				ID:          view.Community.ID,
 				Name:        view.Community.Name,
 				Title:       view.Community.Title,
 				Description: view.Community.Description,
-
-				pages: make(map[string]Page),
-				mutex: new(sync.RWMutex),
 			})
 		}
 		if len(views.Communities) < limit {
@@ -109,5 +115,23 @@ func (c *Cache) fetchCommunities(cli *hb.Client) error {
 		page += 1
 	}
 
+	// An empty list is much more likely to be an upstream problem than every
+	// community being deleted, so keep what we have.
+	if len(all) == 0 {
+		return fmt.Errorf("failed fetching communities: %w", ErrUnavailable)
+	}
+
+	current := make(map[string]bool)
+	for _, community := range all {
+		current[community.Name] = true
+		c.communities.set(community.Name, community)
+	}
+	for _, community := range c.communities.getAll() {
+		if !current[community.Name] {
+			c.infoLog.Println("removing deleted community:", community.Name)
+			c.communities.remove(community.Name)
+		}
+	}
+	c.communities.setListFetched(now)
 	return nil
 }
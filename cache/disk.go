@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskStore is a store which keeps each entry gob encoded in its own file.
+// Only an index of the entries is kept in memory.
+type diskStore[K comparable, V any] struct {
+	mutex  *sync.Mutex
+	dir    string
+	max    int // Zero means unbounded.
+	errLog *log.Logger
+	index  map[K]*list.Element
+	// order holds *diskEntry values with the most recently used at the front.
+	order *list.List
+}
+
+type diskEntry[K comparable] struct {
+	key    K
+	file   string
+	stored time.Time
+}
+
+// diskFile is the contents of each file in a diskStore.
+type diskFile[K comparable, V any] struct {
+	Version int
+	Item    lruItem[K, V]
+}
+
+// openDiskStore opens or creates a diskStore in a directory. The index is
+// built from any entries already in the directory, most recently stored
+// first. Failures to read or write entries are logged to errLog.
+func openDiskStore[K comparable, V any](
+	dir string,
+	max int,
+	errLog *log.Logger,
+) (*diskStore[K, V], error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating cache directory: %v", err)
+	}
+
+	s := &diskStore[K, V]{
+		mutex:  new(sync.Mutex),
+		dir:    dir,
+		max:    max,
+		errLog: errLog,
+		index:  make(map[K]*list.Element),
+		order:  list.New(),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading cache directory: %v", err)
+	}
+	var entries []*diskEntry[K]
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		item, err := s.read(name)
+		if err != nil {
+			// Most likely written by an older version, just drop it.
+			s.removeFile(name)
+			continue
+		}
+		entries = append(entries, &diskEntry[K]{
+			key:    item.Key,
+			file:   name,
+			stored: item.Stored,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stored.Before(entries[j].stored)
+	})
+	for _, entry := range entries {
+		s.index[entry.key] = s.order.PushFront(entry)
+	}
+	return s, nil
+}
+
+// fileName returns the name of the file an entry is stored in.
+func (s *diskStore[K, V]) fileName(key K) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(key)))
+	return hex.EncodeToString(sum[:])
+}
+
+// read decodes an entry from a file in the store's directory. Entries written
+// with another SNAPSHOT_VERSION are an error.
+func (s *diskStore[K, V]) read(name string) (lruItem[K, V], error) {
+	var file diskFile[K, V]
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return file.Item, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&file)
+	if err != nil {
+		return file.Item, err
+	}
+	if file.Version != SNAPSHOT_VERSION {
+		return file.Item, fmt.Errorf(
+			"cache entry %v has version %v, expected %v",
+			name,
+			file.Version,
+			SNAPSHOT_VERSION,
+		)
+	}
+	return file.Item, nil
+}
+
+// write encodes an entry into a file in the store's directory. A temporary
+// file is renamed into place so that readers never see a partial entry.
+func (s *diskStore[K, V]) write(name string, item lruItem[K, V]) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(diskFile[K, V]{
+		Version: SNAPSHOT_VERSION,
+		Item:    item,
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *diskStore[K, V]) get(key K) (V, bool) {
+	var zero V
+	s.mutex.Lock()
+	el, ok := s.index[key]
+	var file string
+	if ok {
+		s.order.MoveToFront(el)
+		file = el.Value.(*diskEntry[K]).file
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return zero, false
+	}
+
+	item, err := s.read(file)
+	if err != nil {
+		s.errLog.Println("failed reading cache entry:", err)
+		s.remove(key)
+		return zero, false
+	}
+	return item.Value, true
+}
+
+func (s *diskStore[K, V]) set(key K, value V) {
+	s.store(lruItem[K, V]{Key: key, Value: value, Stored: time.Now()})
+}
+
+// store writes an item and adds it to the index, evicting the least recently
+// used entries if the store is over its size limit.
+func (s *diskStore[K, V]) store(item lruItem[K, V]) {
+	name := s.fileName(item.Key)
+	err := s.write(name, item)
+	if err != nil {
+		// The store interface has no errors since the memory store can't
+		// fail. Failing to cache something just means it's fetched again.
+		s.errLog.Println("failed writing cache entry:", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if el, ok := s.index[item.Key]; ok {
+		el.Value.(*diskEntry[K]).stored = item.Stored
+		s.order.MoveToFront(el)
+		return
+	}
+	s.index[item.Key] = s.order.PushFront(&diskEntry[K]{
+		key:    item.Key,
+		file:   name,
+		stored: item.Stored,
+	})
+	for s.max > 0 && s.order.Len() > s.max {
+		s.removeElement(s.order.Back())
+	}
+}
+
+func (s *diskStore[K, V]) remove(key K) {
+	s.mutex.Lock()
+	if el, ok := s.index[key]; ok {
+		s.removeElement(el)
+	}
+	s.mutex.Unlock()
+}
+
+// removeElement deletes an entry from the index and disk.
+// The mutex must be held.
+func (s *diskStore[K, V]) removeElement(el *list.Element) {
+	entry := el.Value.(*diskEntry[K])
+	s.order.Remove(el)
+	delete(s.index, entry.key)
+	s.removeFile(entry.file)
+}
+
+// removeFile deletes a file from the store's directory.
+func (s *diskStore[K, V]) removeFile(name string) {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.errLog.Println("failed removing cache entry:", err)
+	}
+}
+
+func (s *diskStore[K, V]) removeOlder(d time.Duration) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var n int
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		if expired(el.Value.(*diskEntry[K]).stored, d) {
+			s.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+func (s *diskStore[K, V]) removeFunc(match func(key K) bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var n int
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*diskEntry[K]).key) {
+			s.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+func (s *diskStore[K, V]) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
+
+func (s *diskStore[K, V]) dump() []lruItem[K, V] {
+	s.mutex.Lock()
+	files := make([]string, 0, s.order.Len())
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		files = append(files, el.Value.(*diskEntry[K]).file)
+	}
+	s.mutex.Unlock()
+
+	items := make([]lruItem[K, V], 0, len(files))
+	for _, file := range files {
+		item, err := s.read(file)
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (s *diskStore[K, V]) restore(items []lruItem[K, V]) {
+	for _, item := range items {
+		s.store(item)
+	}
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestDiskStore(t *testing.T, dir string, max int) *diskStore[string, string] {
+	t.Helper()
+	s, err := openDiskStore[string, string](dir, max, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDiskStore(t *testing.T) {
+	testStore(t, func(t *testing.T, max int) store[string, string] {
+		return openTestDiskStore(t, t.TempDir(), max)
+	})
+}
+
+func TestDiskStoreExpiry(t *testing.T) {
+	testStoreExpiry(t, openTestDiskStore(t, t.TempDir(), 0))
+}
+
+func TestDiskStoreConcurrent(t *testing.T) {
+	testStoreConcurrent(t, openTestDiskStore(t, t.TempDir(), 10), 10)
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s := openTestDiskStore(t, dir, 0)
+	s.restore([]lruItem[string, string]{
+		{Key: "b", Value: "b", Stored: now.Add(-time.Minute * 2)},
+		{Key: "a", Value: "a", Stored: now.Add(-time.Minute * 3)},
+		{Key: "c", Value: "c", Stored: now.Add(-time.Minute)},
+	})
+
+	// Reopened entries are ordered by when they were stored.
+	s = openTestDiskStore(t, dir, 0)
+	if got, want := dumpKeys(s), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if v, ok := s.get("b"); !ok || v != "b" {
+		t.Errorf("got %q, %v, want the stored value", v, ok)
+	}
+	items := s.dump()
+	if len(items) != 3 || !items[0].Stored.Equal(now.Add(-time.Minute*3)) {
+		t.Errorf("got %v, want the stored times kept", items)
+	}
+}
+
+func TestDiskStoreOpenDropsBadFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data func(t *testing.T) []byte
+		kept bool
+	}{
+		{
+			name: "garbage",
+			file: "garbage",
+			data: func(t *testing.T) []byte { return []byte("not gob") },
+		},
+		{
+			name: "empty",
+			file: "empty",
+			data: func(t *testing.T) []byte { return nil },
+		},
+		{
+			name: "other version",
+			file: "old",
+			data: func(t *testing.T) []byte {
+				var b bytes.Buffer
+				err := gob.NewEncoder(&b).Encode(diskFile[string, string]{
+					Version: SNAPSHOT_VERSION - 1,
+					Item:    lruItem[string, string]{Key: "old", Value: "old"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b.Bytes()
+			},
+		},
+		{
+			name: "temporary file",
+			file: ".tmp-1",
+			data: func(t *testing.T) []byte { return []byte("partial") },
+			kept: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			openTestDiskStore(t, dir, 0).set("good", "good")
+			path := filepath.Join(dir, tt.file)
+			err := os.WriteFile(path, tt.data(t), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := openTestDiskStore(t, dir, 0)
+			if got := dumpKeys(s); !slices.Equal(got, []string{"good"}) {
+				t.Errorf("got %v, want only the good entry", got)
+			}
+			_, err = os.Stat(path)
+			if kept := err == nil; kept != tt.kept {
+				t.Errorf("file kept is %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestDiskStoreCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	var errs bytes.Buffer
+	s, err := openDiskStore[string, string](dir, 0, log.New(&errs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.set("a", "a")
+	path := filepath.Join(dir, s.fileName("a"))
+	err = os.WriteFile(path, []byte("corrupt"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.get("a"); ok {
+		t.Errorf("got %q from a corrupt entry, want nothing", v)
+	}
+	if n := s.len(); n != 0 {
+		t.Errorf("got len %d, want the corrupt entry removed", n)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("corrupt file wasn't removed")
+	}
+	if errs.Len() == 0 {
+		t.Error("failing to read the entry wasn't logged")
+	}
+}
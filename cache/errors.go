@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"git.sr.ht/~kota/hex/hb"
+)
+
+// These errors describe why the cache was unable to return some data. They
+// wrap the original error so errors.Is should be used to check for them.
+var (
+	// ErrNotFound is returned when the requested data does not exist on
+	// hexbear.
+	ErrNotFound = errors.New("not found")
+
+	// ErrUnavailable is returned when hexbear could not be reached or
+	// responded with a server error.
+	ErrUnavailable = errors.New("upstream unavailable")
+
+	// ErrTimeout is returned when hexbear took too long to respond.
+	ErrTimeout = errors.New("upstream timed out")
+
+	// ErrRateLimited is returned when hexbear refused the request because we
+	// made too many of them.
+	ErrRateLimited = errors.New("upstream rate limited")
+
+	// ErrDecode is returned when hexbear responded with something we could not
+	// understand.
+	ErrDecode = errors.New("failed decoding upstream response")
+)
+
+// upstreamError annotates an error returned by the hb client with one of the
+// cache errors above, if it matches any of them.
+func upstreamError(msg string, err error) error {
+	kind := classify(err)
+	if kind == nil {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return fmt.Errorf("%s: %w: %w", msg, kind, err)
+}
+
+// classify returns the cache error matching an error returned by the hb
+// client or nil if it doesn't match any of them.
+func classify(err error) error {
+	var apiErr *hb.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.IsNotFound():
+			return ErrNotFound
+		case apiErr.IsRateLimited():
+			return ErrRateLimited
+		case apiErr.IsServerError():
+			return ErrUnavailable
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) ||
+		errors.As(err, &typeErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrDecode
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"git.sr.ht/~kota/hex/hb"
+)
+
+// flight deduplicates concurrent fetches of the same data. While a fetch for a
+// key is running, any other callers with that key wait for it to finish and
+// share its result instead of making their own requests to hexbear.
+//
+// The fetch runs in its own goroutine with a context which is only cancelled
+// once every caller waiting on it has given up.
+type flight struct {
+	mutex *sync.Mutex
+	calls map[string]*call
+}
+
+// call is a fetch which is in progress or has just completed.
+type call struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlight() flight {
+	var f flight
+	f.mutex = new(sync.Mutex)
+	f.calls = make(map[string]*call)
+	return f
+}
+
+// running reports if a call is currently running for the given key.
+func (f flight) running(key string) bool {
+	f.mutex.Lock()
+	_, ok := f.calls[key]
+	f.mutex.Unlock()
+	return ok
+}
+
+// do runs fn unless it's already running for the given key, in which case it
+// waits for the running call to finish instead. Either way the error from the
+// call is returned. If ctx is done before the call finishes its error is
+// returned instead.
+func (f flight) do(
+	ctx context.Context,
+	key string,
+	fn func(context.Context) error,
+) error {
+	f.mutex.Lock()
+	cl, ok := f.calls[key]
+	if !ok {
+		// The fetch keeps the values of the first caller's context, but not
+		// its cancellation, since other callers may still be waiting.
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		cl = &call{done: make(chan struct{}), cancel: cancel}
+		f.calls[key] = cl
+		go f.run(fctx, key, cl, fn)
+	}
+	cl.waiters++
+	f.mutex.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.err
+	case <-ctx.Done():
+		f.mutex.Lock()
+		cl.waiters--
+		if cl.waiters == 0 {
+			// Nobody cares about the result anymore.
+			cl.cancel()
+			f.forget(key, cl)
+		}
+		f.mutex.Unlock()
+		return fmt.Errorf("waiting on fetch %v: %w", key, ctx.Err())
+	}
+}
+
+// run runs a call's function and reports its result to the waiters.
+func (f flight) run(
+	ctx context.Context,
+	key string,
+	cl *call,
+	fn func(context.Context) error,
+) {
+	defer func() {
+		if r := recover(); r != nil {
+			cl.err = fmt.Errorf("panic fetching %v: %v", key, r)
+		}
+		f.mutex.Lock()
+		f.forget(key, cl)
+		f.mutex.Unlock()
+		cl.cancel()
+		close(cl.done)
+	}()
+	cl.err = fn(ctx)
+}
+
+// forget removes a call from the map so the next caller starts a new one.
+// The mutex must be held.
+func (f flight) forget(key string, cl *call) {
+	if f.calls[key] == cl {
+		delete(f.calls, key)
+	}
+}
+
+// homeKey is the flight key for fetching a page of the home page.
+func homeKey(page int, sort hb.SortType) string {
+	return "home:" + strconv.Itoa(page) + ":" + string(sort)
+}
+
+// communityKey is the flight key for fetching a page of a community.
+func communityKey(name string, page int, sort hb.SortType) string {
+	return "community:" + name + ":" + strconv.Itoa(page) + ":" + string(sort)
+}
+
+// commentsKey is the flight key for fetching the comments on a post.
+func commentsKey(postID int, sort hb.CommentSortType) string {
+	return "comments:" + strconv.Itoa(postID) + ":" + string(sort)
+}
+
+// commentsPageKey is the flight key for fetching a further page of comments on
+// a post.
+func commentsPageKey(postID int, sort hb.CommentSortType, page int) string {
+	return commentsKey(postID, sort) + ":" + strconv.Itoa(page)
+}
+
+// branchKey is the flight key for fetching the replies to a comment.
+func branchKey(postID int, parentID int, sort hb.CommentSortType) string {
+	return "branch:" + strconv.Itoa(postID) + ":" + strconv.Itoa(parentID) +
+		":" + string(sort)
+}
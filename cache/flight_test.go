@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightDedup(t *testing.T) {
+	f := newFlight()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	errFetch := errors.New("fetch failed")
+	fn := func(ctx context.Context) error {
+		calls.Add(1)
+		<-release
+		return errFetch
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f.do(context.Background(), "key", fn)
+		}(i)
+	}
+	// A different key isn't shared with the others.
+	other := f.do(context.Background(), "other", func(context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+	time.Sleep(time.Millisecond * 50)
+	if !f.running("key") {
+		t.Error("key isn't running while its fetch is")
+	}
+	close(release)
+	wg.Wait()
+
+	if other != nil {
+		t.Errorf("got %v for the other key, want nil", other)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("fetched %d times, want 2", n)
+	}
+	for i, err := range errs {
+		if err != errFetch {
+			t.Errorf("caller %d got %v, want %v", i, err, errFetch)
+		}
+	}
+	if f.running("key") {
+		t.Error("key is still running after its fetch finished")
+	}
+}
+
+type ctxKey struct{}
+
+func TestFlightCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiters int
+		cancel  int
+		// fetchCancelled is whether the fetch's context should be cancelled
+		// once cancel of the waiters give up.
+		fetchCancelled bool
+	}{
+		{name: "one of one gives up", waiters: 1, cancel: 1, fetchCancelled: true},
+		{name: "first of two gives up", waiters: 2, cancel: 1},
+		{name: "both of two give up", waiters: 2, cancel: 2, fetchCancelled: true},
+		{name: "two of three give up", waiters: 3, cancel: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFlight()
+			started := make(chan struct{})
+			release := make(chan struct{})
+			fetchDone := make(chan error, 1)
+			var value any
+			fn := func(ctx context.Context) error {
+				value = ctx.Value(ctxKey{})
+				close(started)
+				select {
+				case <-ctx.Done():
+					fetchDone <- ctx.Err()
+				case <-release:
+					fetchDone <- nil
+				}
+				return nil
+			}
+
+			// Waiters are started in order so the first one runs the fetch
+			// with its context.
+			cancels := make([]context.CancelFunc, tt.waiters)
+			results := make([]chan error, tt.waiters)
+			for i := range cancels {
+				ctx := context.WithValue(context.Background(), ctxKey{}, i)
+				ctx, cancels[i] = context.WithCancel(ctx)
+				defer cancels[i]()
+				results[i] = make(chan error, 1)
+				go func(i int) {
+					results[i] <- f.do(ctx, "key", fn)
+				}(i)
+				if i == 0 {
+					<-started
+				} else {
+					time.Sleep(time.Millisecond * 10)
+				}
+			}
+
+			for i := 0; i < tt.cancel; i++ {
+				cancels[i]()
+				err := <-results[i]
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("waiter %d got %v, want %v", i, err, context.Canceled)
+				}
+			}
+
+			if tt.fetchCancelled {
+				select {
+				case err := <-fetchDone:
+					if !errors.Is(err, context.Canceled) {
+						t.Errorf("fetch ended with %v, want it cancelled", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("fetch wasn't cancelled once every waiter gave up")
+				}
+				if f.running("key") {
+					t.Error("key is still running after every waiter gave up")
+				}
+			} else {
+				select {
+				case err := <-fetchDone:
+					t.Fatalf("fetch ended with %v while callers were waiting", err)
+				case <-time.After(time.Millisecond * 50):
+				}
+				close(release)
+				for i := tt.cancel; i < tt.waiters; i++ {
+					if err := <-results[i]; err != nil {
+						t.Errorf("waiter %d got %v, want nil", i, err)
+					}
+				}
+			}
+			if value != 0 {
+				t.Errorf("fetch context has value %v, want the first caller's", value)
+			}
+		})
+	}
+}
+
+func TestFlightPanic(t *testing.T) {
+	f := newFlight()
+	err := f.do(context.Background(), "key", func(context.Context) error {
+		panic("oops")
+	})
+	if err == nil {
+		t.Fatal("got no error from a fetch which panicked")
+	}
+	err = f.do(context.Background(), "key", func(context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("got %v after a panic, want the next fetch to run", err)
+	}
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru is a size bounded mapping which evicts its least recently used entries
+// once it's full.
+type lru[K comparable, V any] struct {
+	mutex *sync.Mutex
+	max   int // Zero means unbounded.
+	items map[K]*list.Element
+	// order holds *lruEntry values with the most recently used at the front.
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key    K
+	value  V
+	stored time.Time
+}
+
+func newLRU[K comparable, V any](max int) *lru[K, V] {
+	return &lru[K, V]{
+		mutex: new(sync.Mutex),
+		max:   max,
+		items: make(map[K]*list.Element),
+		order: list.New(),
+	}
+}
+
+// get returns the value for a key and marks it as recently used.
+func (l *lru[K, V]) get(key K) (V, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).value, true
+}
+
+// set stores a value for a key, evicting the least recently used entries if
+// the lru is over its size limit.
+func (l *lru[K, V]) set(key K, value V) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if el, ok := l.items[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.stored = time.Now()
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry[K, V]{
+		key:    key,
+		value:  value,
+		stored: time.Now(),
+	})
+	for l.max > 0 && l.order.Len() > l.max {
+		l.removeElement(l.order.Back())
+	}
+}
+
+// remove deletes the entry for a key if it exists.
+func (l *lru[K, V]) remove(key K) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+// removeOlder deletes every entry which was stored longer than d ago and
+// returns how many were deleted.
+func (l *lru[K, V]) removeOlder(d time.Duration) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var n int
+	for el := l.order.Front(); el != nil; {
+		next := el.Next()
+		if expired(el.Value.(*lruEntry[K, V]).stored, d) {
+			l.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// removeFunc deletes every entry whose key matches and returns how many were
+// deleted.
+func (l *lru[K, V]) removeFunc(match func(key K) bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var n int
+	for el := l.order.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*lruEntry[K, V]).key) {
+			l.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// len returns the number of entries.
+func (l *lru[K, V]) len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.order.Len()
+}
+
+// removeElement deletes an element from the list and map.
+// The mutex must be held.
+func (l *lru[K, V]) removeElement(el *list.Element) {
+	l.order.Remove(el)
+	delete(l.items, el.Value.(*lruEntry[K, V]).key)
+}
+
+// lruItem is an exported copy of an lru entry used for snapshots.
+type lruItem[K comparable, V any] struct {
+	Key    K
+	Value  V
+	Stored time.Time
+}
+
+// dump returns every entry ordered from least to most recently used.
+func (l *lru[K, V]) dump() []lruItem[K, V] {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	items := make([]lruItem[K, V], 0, l.order.Len())
+	for el := l.order.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*lruEntry[K, V])
+		items = append(items, lruItem[K, V]{
+			Key:    entry.key,
+			Value:  entry.value,
+			Stored: entry.stored,
+		})
+	}
+	return items
+}
+
+// restore adds entries returned by dump, keeping their stored times and
+// order. Existing entries with the same keys are replaced.
+func (l *lru[K, V]) restore(items []lruItem[K, V]) {
+	for _, item := range items {
+		l.set(item.Key, item.Value)
+		l.mutex.Lock()
+		if el, ok := l.items[item.Key]; ok {
+			el.Value.(*lruEntry[K, V]).stored = item.Stored
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeTests are run against each store backend. Each op is "set k", "get k",
+// "miss k", or "remove k", where get and miss check if k is stored. want is
+// the keys left afterwards from least to most recently used.
+var storeTests = []struct {
+	name string
+	max  int
+	ops  []string
+	want []string
+}{
+	{
+		name: "unbounded",
+		ops:  []string{"set a", "set b", "set c", "set d"},
+		want: []string{"a", "b", "c", "d"},
+	},
+	{
+		name: "evicts least recently used",
+		max:  2,
+		ops:  []string{"set a", "set b", "set c", "miss a", "get b"},
+		want: []string{"c", "b"},
+	},
+	{
+		name: "get marks used",
+		max:  2,
+		ops:  []string{"set a", "set b", "get a", "set c", "miss b"},
+		want: []string{"a", "c"},
+	},
+	{
+		name: "set replaces and marks used",
+		max:  2,
+		ops:  []string{"set a", "set b", "set a", "set c", "miss b"},
+		want: []string{"a", "c"},
+	},
+	{
+		name: "miss doesn't mark used",
+		max:  2,
+		ops:  []string{"set a", "set b", "miss c", "set c"},
+		want: []string{"b", "c"},
+	},
+	{
+		name: "remove",
+		ops:  []string{"set a", "set b", "set c", "remove b", "miss b", "remove x"},
+		want: []string{"a", "c"},
+	},
+	{
+		name: "limit of one",
+		max:  1,
+		ops:  []string{"set a", "set b", "miss a", "get b"},
+		want: []string{"b"},
+	},
+}
+
+// testStore runs storeTests against stores created by open. Stored values
+// are their keys.
+func testStore(t *testing.T, open func(t *testing.T, max int) store[string, string]) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t, tt.max)
+			for _, op := range tt.ops {
+				name, key, _ := strings.Cut(op, " ")
+				switch name {
+				case "set":
+					s.set(key, key)
+				case "get":
+					v, ok := s.get(key)
+					if !ok || v != key {
+						t.Errorf("%v: got %q, %v, want %q", op, v, ok, key)
+					}
+				case "miss":
+					if v, ok := s.get(key); ok {
+						t.Errorf("%v: got %q, want nothing", op, v)
+					}
+				case "remove":
+					s.remove(key)
+				}
+			}
+			if got := dumpKeys(s); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if n := s.len(); n != len(tt.want) {
+				t.Errorf("got len %d, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
+
+// testStoreExpiry checks a store keeps stored times through dump and restore
+// and removes old entries.
+func testStoreExpiry(t *testing.T, s store[string, string]) {
+	now := time.Now()
+	s.restore([]lruItem[string, string]{
+		{Key: "old", Value: "old", Stored: now.Add(-time.Hour * 2)},
+		{Key: "recent", Value: "recent", Stored: now.Add(-time.Minute)},
+		{Key: "older", Value: "older", Stored: now.Add(-time.Hour * 3)},
+		{Key: "new", Value: "new", Stored: now},
+	})
+	items := s.dump()
+	if len(items) != 4 || !items[2].Stored.Equal(now.Add(-time.Hour*3)) {
+		t.Fatalf("got %v, want the restored items with their stored times", items)
+	}
+
+	if n := s.removeOlder(time.Hour); n != 2 {
+		t.Errorf("removed %d old entries, want 2", n)
+	}
+	if got, want := dumpKeys(s), []string{"recent", "new"}; !slices.Equal(got, want) {
+		t.Errorf("got %v after removing old entries, want %v", got, want)
+	}
+
+	n := s.removeFunc(func(key string) bool { return key == "new" })
+	if n != 1 {
+		t.Errorf("removed %d matching entries, want 1", n)
+	}
+	if got, want := dumpKeys(s), []string{"recent"}; !slices.Equal(got, want) {
+		t.Errorf("got %v after removing matching entries, want %v", got, want)
+	}
+}
+
+// testStoreConcurrent uses a store from several goroutines at once, to be
+// run with the race detector.
+func testStoreConcurrent(t *testing.T, s store[string, string], max int) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := strconv.Itoa((i + j) % (max * 2))
+				s.set(key, key)
+				if v, ok := s.get(key); ok && v != key {
+					t.Errorf("got %q for key %q", v, key)
+				}
+				s.removeOlder(time.Hour)
+				s.dump()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := s.len(); n > max {
+		t.Errorf("got len %d, want at most %d", n, max)
+	}
+}
+
+// dumpKeys returns the keys in a store from least to most recently used.
+func dumpKeys(s store[string, string]) []string {
+	var keys []string
+	for _, item := range s.dump() {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+func TestLRU(t *testing.T) {
+	testStore(t, func(t *testing.T, max int) store[string, string] {
+		return newLRU[string, string](max)
+	})
+}
+
+func TestLRUExpiry(t *testing.T) {
+	testStoreExpiry(t, newLRU[string, string](0))
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	testStoreConcurrent(t, newLRU[string, string](10), 10)
+}
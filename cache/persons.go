@@ -11,6 +11,7 @@ import (
 	"git.sr.ht/~kota/hex/hb"
 )
 
+// PERSON_TTL is the default for Options.PersonTTL.
 const PERSON_TTL = time.Minute * 40
 
 type Person struct {
@@ -18,39 +19,65 @@ type Person struct {
 	Name        string        `json:"name"`
 	DisplayName string        `json:"display_name"`
 	Bio         template.HTML `json:"bio"`
+	BioMarkdown string        // Bio before it was rendered.
 	Local       bool          `json:"local"`
 	Published   time.Time     `json:"published"`
 	Updated     time.Time     `json:"updated"`
 
+	URL          string
 	CommentCount int
 	PostCount    int
 	PostIDs      []int
 	Fetched      time.Time
+
+	// Stale is set when the person has expired and is being refreshed.
+	Stale bool
 }
 
 // Person returns a given Person.
 // The cached version is returned if it exists and has not expired, otherwise,
 // they are fetched. The user's posts are also retrieved as part of this
-// request.
-func (c *Cache) Person(cli *hb.Client, name string) (Person, error) {
+// request. A stale person is returned while being refreshed in the
+// background.
+func (c *Cache) Person(
+	ctx context.Context,
+	cli *hb.Client,
+	name string,
+) (Person, error) {
+	key := "person:" + name
+	fetch := func(ctx context.Context) error {
+		return c.fetchPerson(ctx, cli, name)
+	}
+
 	person, ok := c.persons.get(name)
-	if !ok || expired(person.Fetched, PERSON_TTL) {
-		err := c.fetchPerson(cli, name)
-		if err != nil {
-			return person, err
-		}
-		person, _ = c.persons.get(name)
+	switch c.freshness(ok, person.Fetched, c.ttl().person) {
+	case fresh:
+		return person, nil
+	case stale:
+		c.revalidate(key, fetch)
+		person.Stale = true
+		return person, nil
+	}
+
+	err := c.flights.do(ctx, key, fetch)
+	if err != nil {
+		return person, err
 	}
+	person, _ = c.persons.get(name)
 	return person, nil
 }
 
 // fetchPerson retrieves a person along with their posts.
-func (c *Cache) fetchPerson(cli *hb.Client, name string) error {
+func (c *Cache) fetchPerson(
+	ctx context.Context,
+	cli *hb.Client,
+	name string,
+) error {
 	c.infoLog.Println("fetching person:", name)
 
-	pr, resp, err := cli.Person(context.Background(), 0, name)
+	pr, _, err := cli.Person(ctx, 0, name)
 	if err != nil || pr == nil {
-		return fmt.Errorf("failed fetching person: %v resp: %v", err, resp)
+		return upstreamError(fmt.Sprintf("failed fetching person %v", name), err)
 	}
 
 	var postIDs []int
@@ -76,11 +103,13 @@ func (c *Cache) fetchPerson(cli *hb.Client, name string) error {
 			false, // No concept of moderator on a person view page.
 			false, // No concept of OP on a person view page.
 		),
-		Bio:       bio,
-		Local:     pr.PersonView.Person.Local,
-		Published: pr.PersonView.Person.Published,
-		Updated:   pr.PersonView.Person.Updated,
+		Bio:         bio,
+		BioMarkdown: pr.PersonView.Person.Bio,
+		Local:       pr.PersonView.Person.Local,
+		Published:   pr.PersonView.Person.Published,
+		Updated:     pr.PersonView.Person.Updated,
 
+		URL:          processPersonURL(pr.PersonView.Person),
 		CommentCount: pr.PersonView.Counts.CommentCount,
 		PostCount:    pr.PersonView.Counts.PostCount,
 		PostIDs:      postIDs,
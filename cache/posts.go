@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,9 +12,14 @@ import (
 )
 
 const (
-	POSTS_PER_PAGE = 50 // 50 seems to be the max we can request.
-	PAGE_TTL       = time.Minute * 15
-	POST_TTL       = time.Minute * 15
+	// POSTS_PER_PAGE is the default for Options.PostsPerPage and the most
+	// hexbear allows.
+	POSTS_PER_PAGE = 50
+
+	// PAGE_TTL and POST_TTL are the defaults for Options.PageTTL and
+	// Options.PostTTL.
+	PAGE_TTL = time.Minute * 15
+	POST_TTL = time.Minute * 15
 )
 
 type Post struct {
@@ -21,6 +27,7 @@ type Post struct {
 	Name              string `json:"name"`
 	URL               string `json:"url"`
 	Body              template.HTML
+	BodyMarkdown      string     // Body before it was rendered.
 	CommunityID       int        `json:"community_id"`
 	Published         time.Time  `json:"published"`
 	Updated           *time.Time `json:"updated"`
@@ -35,30 +42,46 @@ type Post struct {
 	Upvotes            int
 	CommentCount       int
 	Fetched            time.Time
+
+	// Stale is set when the post has expired and is being refreshed.
+	Stale bool
 }
 
 // Post returns a given post.
 // The cached version is returned if it exists and has not expired, otherwise,
-// they are fetched.
-func (c *Cache) Post(cli *hb.Client, id int) (Post, error) {
+// they are fetched. Stale posts are returned while being refreshed in the
+// background.
+func (c *Cache) Post(ctx context.Context, cli *hb.Client, id int) (Post, error) {
+	key := "post:" + strconv.Itoa(id)
+	fetch := func(ctx context.Context) error {
+		return c.fetchPost(ctx, cli, id)
+	}
+
 	post, ok := c.posts.get(id)
-	if !ok || expired(post.Fetched, POST_TTL) {
-		err := c.fetchPost(cli, id)
-		if err != nil {
-			return post, err
-		}
-		post, _ = c.posts.get(id)
+	switch c.freshness(ok, post.Fetched, c.ttl().post) {
+	case fresh:
+		return post, nil
+	case stale:
+		c.revalidate(key, fetch)
+		post.Stale = true
+		return post, nil
+	}
+
+	err := c.flights.do(ctx, key, fetch)
+	if err != nil {
+		return post, err
 	}
+	post, _ = c.posts.get(id)
 	return post, nil
 }
 
 // fetchPost retrieves a given post and all of its comments.
-func (c *Cache) fetchPost(cli *hb.Client, postID int) error {
+func (c *Cache) fetchPost(ctx context.Context, cli *hb.Client, postID int) error {
 	c.infoLog.Println("fetching post:", postID)
 
-	pr, resp, err := cli.Post(context.Background(), postID)
+	pr, _, err := cli.Post(ctx, postID)
 	if err != nil || pr == nil {
-		return fmt.Errorf("failing fetching post: %v resp: %v", err, resp)
+		return upstreamError(fmt.Sprintf("failed fetching post %v", postID), err)
 	}
 
 	return c.storePost(pr.PostView)
@@ -67,40 +90,60 @@ func (c *Cache) fetchPost(cli *hb.Client, postID int) error {
 // Home returns the home page.
 // The cached version is returned if it exists and has not expired, otherwise,
 // they are fetched fresh. If the posts are fetched their comments are NOT
-// fetched.
-func (c *Cache) Home(cli *hb.Client, page int, sort hb.SortType) (Page, error) {
+// fetched. A stale page is returned while being refreshed in the background.
+func (c *Cache) Home(
+	ctx context.Context,
+	cli *hb.Client,
+	page int,
+	sort hb.SortType,
+) (Page, error) {
+	c.hits.add("", page, sort)
+	key := homeKey(page, sort)
+	fetch := func(ctx context.Context) error {
+		return c.fetchHome(ctx, cli, page, sort)
+	}
+
 	home, ok := c.home.get(page, sort)
-	if ok && !expired(home.Fetched, PAGE_TTL) {
+	switch c.freshness(ok, home.Fetched, c.ttl().page) {
+	case fresh:
+		return home, nil
+	case stale:
+		c.revalidate(key, fetch)
+		home.Stale = true
 		return home, nil
 	}
-	err := c.fetchHome(cli, page, sort)
+
+	err := c.flights.do(ctx, key, fetch)
 	home, _ = c.home.get(page, sort)
 	return home, err
 }
 
 // fetchHome retrieves all of the posts needed for the home page.
-func (c *Cache) fetchHome(cli *hb.Client, page int, sort hb.SortType) error {
+func (c *Cache) fetchHome(
+	ctx context.Context,
+	cli *hb.Client,
+	page int,
+	sort hb.SortType,
+) error {
 	c.infoLog.Println("fetching home posts page:", page)
 	now := time.Now()
 
-	limit := POSTS_PER_PAGE
+	limit := c.postsPerPage
 	home := Page{
 		Fetched: now,
 	}
-	views, resp, err := cli.PostList(
-		context.Background(),
+	views, _, err := cli.PostList(
+		ctx,
 		0,
 		page,
 		limit,
 		sort,
-		hb.ListingTypeLocal,
+		c.listingType,
 	)
 	if err != nil || views == nil {
-		return fmt.Errorf(
-			"failing fetching home posts page: %v: err %v: resp: %v",
-			page,
+		return upstreamError(
+			fmt.Sprintf("failed fetching home posts page %v", page),
 			err,
-			resp,
 		)
 	}
 
@@ -119,32 +162,43 @@ func (c *Cache) fetchHome(cli *hb.Client, page int, sort hb.SortType) error {
 // CommunityPosts returns a page of posts within a community.
 // The cached version is returned if it exists and has not expired, otherwise,
 // they are fetched fresh. If the posts are fetched their comments are NOT
-// fetched.
+// fetched. A stale page is returned while being refreshed in the background.
 func (c *Cache) CommunityPosts(
+	ctx context.Context,
 	cli *hb.Client,
 	communityName string,
 	pageNum int,
 	sort hb.SortType,
 ) (Page, error) {
-	community, ok := c.communities.get(communityName)
-	if !ok {
-		err := c.fetchCommunities(cli)
-		if err != nil {
-		}
-		community, _ = c.communities.get(communityName)
+	_, err := c.Community(ctx, cli, communityName)
+	if err != nil {
+		return Page{}, err
 	}
 
-	page, ok := community.get(pageNum, sort)
-	if ok && !expired(page.Fetched, PAGE_TTL) {
+	c.hits.add(communityName, pageNum, sort)
+	key := communityKey(communityName, pageNum, sort)
+	fetch := func(ctx context.Context) error {
+		return c.fetchCommunityPosts(ctx, cli, communityName, pageNum, sort)
+	}
+
+	page, ok := c.communities.getPage(communityName, pageNum, sort)
+	switch c.freshness(ok, page.Fetched, c.ttl().page) {
+	case fresh:
+		return page, nil
+	case stale:
+		c.revalidate(key, fetch)
+		page.Stale = true
 		return page, nil
 	}
-	err := c.fetchCommunityPosts(cli, communityName, pageNum, sort)
-	page, _ = community.get(pageNum, sort)
+
+	err = c.flights.do(ctx, key, fetch)
+	page, _ = c.communities.getPage(communityName, pageNum, sort)
 	return page, err
 }
 
 // fetchCommunityPosts retrieves all of the posts for a given page of a community.
 func (c *Cache) fetchCommunityPosts(
+	ctx context.Context,
 	cli *hb.Client,
 	communityName string,
 	pageNum int,
@@ -152,30 +206,31 @@ func (c *Cache) fetchCommunityPosts(
 ) error {
 	community, ok := c.communities.get(communityName)
 	if !ok {
-		return fmt.Errorf("requested community %v does not exist", communityName)
+		return fmt.Errorf("community %v: %w", communityName, ErrNotFound)
 	}
 	c.infoLog.Printf("fetching %v posts page: %v\n", community.Name, pageNum)
 	now := time.Now()
 
-	limit := POSTS_PER_PAGE
+	limit := c.postsPerPage
 	page := Page{
 		Fetched: now,
 	}
-	views, resp, err := cli.PostList(
-		context.Background(),
+	views, _, err := cli.PostList(
+		ctx,
 		community.ID,
 		pageNum,
 		limit,
 		sort,
-		hb.ListingTypeLocal,
+		c.listingType,
 	)
 	if err != nil || views == nil {
-		return fmt.Errorf(
-			"failing fetching %v posts page: %v: err %v: resp: %v",
-			community.Name,
-			pageNum,
+		return upstreamError(
+			fmt.Sprintf(
+				"failed fetching %v posts page %v",
+				community.Name,
+				pageNum,
+			),
 			err,
-			resp,
 		)
 	}
 
@@ -187,7 +242,7 @@ func (c *Cache) fetchCommunityPosts(
 		page.PostIDs = append(page.PostIDs, view.Post.ID)
 	}
 
-	community.set(pageNum, sort, page)
+	c.communities.setPage(communityName, pageNum, sort, page)
 	return nil
 }
 
@@ -195,7 +250,7 @@ func (c *Cache) fetchCommunityPosts(
 func (c *Cache) storePost(view hb.PostView) error {
 	url := view.Post.URL
 	var image string
-	if strings.HasPrefix(view.Post.URL, "https://hexbear.net/pictrs/image/") {
+	if c.hostedImage(url) {
 		image = url
 		url = ""
 	}
@@ -210,6 +265,7 @@ func (c *Cache) storePost(view hb.PostView) error {
 		Name:              view.Post.Name,
 		URL:               url,
 		Body:              body,
+		BodyMarkdown:      view.Post.Body,
 		CommunityID:       view.Post.CommunityID,
 		Published:         view.Post.Published,
 		Updated:           view.Post.Updated,
@@ -232,3 +288,13 @@ func (c *Cache) storePost(view hb.PostView) error {
 	})
 	return nil
 }
+
+// hostedImage reports if the URL is of an image hosted by the instance.
+func (c *Cache) hostedImage(url string) bool {
+	for _, host := range []string{c.host, "www." + c.host} {
+		if strings.HasPrefix(url, "https://"+host+"/pictrs/image/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~kota/hex/hb"
+)
+
+const (
+	// REFRESH_INTERVAL is the default for Options.RefreshInterval.
+	REFRESH_INTERVAL = time.Minute
+
+	// REFRESH_BUDGET is the default for Options.RefreshBudget.
+	REFRESH_BUDGET = 30
+
+	// REFRESH_AHEAD is the fraction of a TTL after which the scheduler
+	// considers data due for a refresh.
+	REFRESH_AHEAD = 0.8
+
+	// REFRESH_PAGES is how many of the most requested pages are kept warm.
+	REFRESH_PAGES = 20
+)
+
+// hotPage is the first page of the home page or of a community for a given
+// sorting method. An empty community means the home page.
+type hotPage struct {
+	community string
+	sort      hb.SortType
+}
+
+// hits counts requests for the first page of each listing so the scheduler
+// knows which ones are popular. The counts are halved after each run of the
+// scheduler so that they follow recent traffic.
+type hits struct {
+	mutex  *sync.Mutex
+	counts map[hotPage]float64
+}
+
+func newHits() hits {
+	var h hits
+	h.mutex = new(sync.Mutex)
+	h.counts = make(map[hotPage]float64)
+	return h
+}
+
+// add records a request for a page. Only first pages are counted.
+func (h hits) add(community string, page int, sort hb.SortType) {
+	if page != 1 {
+		return
+	}
+	h.mutex.Lock()
+	h.counts[hotPage{community: community, sort: sort}]++
+	h.mutex.Unlock()
+}
+
+// hottest returns up to n of the most requested pages and decays the counts.
+func (h hits) hottest(n int) []hotPage {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	pages := make([]hotPage, 0, len(h.counts))
+	for p := range h.counts {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return h.counts[pages[i]] > h.counts[pages[j]]
+	})
+	if len(pages) > n {
+		pages = pages[:n]
+	}
+
+	for p, count := range h.counts {
+		if count < 1 {
+			delete(h.counts, p)
+		} else {
+			h.counts[p] = count / 2
+		}
+	}
+	return pages
+}
+
+// scheduler periodically refreshes the most requested pages shortly before
+// they expire, along with the cached comments of the posts on them, so that
+// visitors rarely wait on hexbear. At most budget requests per minute are
+// spent doing so.
+func (c *Cache) scheduler(interval time.Duration, budget int) {
+	perRun := int(float64(budget) * interval.Minutes())
+	if perRun < 1 {
+		perRun = 1
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		spent := c.refreshCommunities(perRun)
+		spent += c.refreshHot(perRun - spent)
+		if spent > 0 {
+			c.infoLog.Println("refreshed hot pages with requests:", spent)
+		}
+	}
+}
+
+// refreshCommunities refreshes the list of communities if it's due and can be
+// fetched within budget requests. The number of requests spent is returned.
+func (c *Cache) refreshCommunities(budget int) int {
+	if !due(c.communities.listFetched(), c.ttl().community) {
+		return 0
+	}
+	// Communities are fetched in pages of 50.
+	cost := c.communities.cache.len()/50 + 1
+	if cost > budget {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		c.backgroundTimeout,
+	)
+	defer cancel()
+	err := c.flights.do(ctx, "communities", func(ctx context.Context) error {
+		return c.fetchCommunities(ctx, c.cli)
+	})
+	if err != nil {
+		c.errLog.Println("failed refreshing communities", err)
+	}
+	return cost
+}
+
+// refreshHot refreshes hot pages which are due without spending more than
+// budget requests. The number of requests spent is returned.
+func (c *Cache) refreshHot(budget int) int {
+	var spent int
+	for _, hot := range c.hits.hottest(REFRESH_PAGES) {
+		if spent >= budget {
+			break
+		}
+
+		key := homeKey(1, hot.sort)
+		get := func() (Page, bool) {
+			return c.home.get(1, hot.sort)
+		}
+		fetch := func(ctx context.Context) error {
+			return c.fetchHome(ctx, c.cli, 1, hot.sort)
+		}
+		if hot.community != "" {
+			key = communityKey(hot.community, 1, hot.sort)
+			get = func() (Page, bool) {
+				return c.communities.getPage(hot.community, 1, hot.sort)
+			}
+			fetch = func(ctx context.Context) error {
+				return c.fetchCommunityPosts(ctx, c.cli, hot.community, 1, hot.sort)
+			}
+		}
+
+		page, ok := get()
+		if !ok || due(page.Fetched, c.ttl().page) {
+			spent++
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				c.backgroundTimeout,
+			)
+			err := c.flights.do(ctx, key, fetch)
+			cancel()
+			if err != nil {
+				c.errLog.Println("failed refreshing hot page", key, err)
+				continue
+			}
+			page, _ = get()
+		}
+
+		for _, id := range page.PostIDs {
+			if spent >= budget {
+				break
+			}
+			spent += c.refreshComments(id, budget-spent)
+		}
+	}
+	return spent
+}
+
+// refreshComments refreshes the cached comments on a post, in each sorting
+// method that's cached, if they're due and can be fetched within budget
+// requests. The number of requests spent is returned.
+func (c *Cache) refreshComments(postID int, budget int) int {
+	post, ok := c.posts.get(postID)
+	if !ok {
+		return 0
+	}
+	// Only the first page of comments is fetched again, the rest of those
+	// loaded are kept.
+	cost := 1
+
+	var spent int
+	for _, sort := range []hb.CommentSortType{
+		hb.CommentSortTypeHot,
+		hb.CommentSortTypeTop,
+		hb.CommentSortTypeNew,
+		hb.CommentSortTypeOld,
+	} {
+		comments, ok := c.comments.get(postID, sort)
+		if !ok || !due(comments.Fetched, c.ttl().post) {
+			continue
+		}
+		if spent+cost > budget {
+			break
+		}
+		spent += cost
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			c.backgroundTimeout,
+		)
+		key := commentsKey(postID, sort)
+		err := c.flights.do(ctx, key, func(ctx context.Context) error {
+			return c.fetchComments(ctx, c.cli, postID, sort, post.CreatorID)
+		})
+		cancel()
+		if err != nil {
+			c.errLog.Println("failed refreshing comments", postID, err)
+		}
+	}
+	return spent
+}
+
+// due returns if data fetched at a given time is close enough to expiring
+// that the scheduler should refresh it.
+func due(fetched time.Time, ttl time.Duration) bool {
+	return expired(fetched, time.Duration(float64(ttl)*REFRESH_AHEAD))
+}
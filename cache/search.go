@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~kota/hex/hb"
+)
+
+const (
+	// SEARCH_TTL is the default for Options.SearchTTL.
+	SEARCH_TTL = time.Minute * 5
+
+	// SEARCH_RESULTS is the number of results of each type on a page.
+	SEARCH_RESULTS = 20
+)
+
+// SearchResults holds a single page of results for a search. Only the
+// results of the type searched for are set.
+type SearchResults struct {
+	PostIDs     []int
+	Comments    Comments
+	Communities []Community
+	Persons     []Person // Only the names, URL, and counts are set.
+	Fetched     time.Time
+
+	// Stale is set when the results have expired and are being refreshed.
+	Stale bool
+}
+
+// Search returns a page of results for a search on hexbear, optionally within
+// a single community. The posts found are cached along with the results.
+// The cached version is returned if it exists and has not expired, otherwise,
+// they are fetched. Stale results are returned while being refreshed in the
+// background.
+func (c *Cache) Search(
+	ctx context.Context,
+	cli *hb.Client,
+	query string,
+	searchType hb.SearchType,
+	community string,
+	page int,
+	sort hb.SortType,
+) (SearchResults, error) {
+	key := searchKey(query, searchType, community, page, sort)
+	fetch := func(ctx context.Context) error {
+		return c.fetchSearch(ctx, cli, query, searchType, community, page, sort)
+	}
+
+	results, ok := c.searches.get(key)
+	switch c.freshness(ok, results.Fetched, c.ttl().search) {
+	case fresh:
+		return results, nil
+	case stale:
+		c.revalidate("search:"+key, fetch)
+		results.Stale = true
+		return results, nil
+	}
+
+	err := c.flights.do(ctx, "search:"+key, fetch)
+	if err != nil {
+		return results, err
+	}
+	results, _ = c.searches.get(key)
+	return results, nil
+}
+
+// fetchSearch retrieves a page of search results.
+func (c *Cache) fetchSearch(
+	ctx context.Context,
+	cli *hb.Client,
+	query string,
+	searchType hb.SearchType,
+	community string,
+	page int,
+	sort hb.SortType,
+) error {
+	c.infoLog.Printf("fetching search page %v: %q\n", page, query)
+
+	sr, _, err := cli.Search(
+		ctx,
+		query,
+		searchType,
+		community,
+		page,
+		SEARCH_RESULTS,
+		sort,
+	)
+	if err != nil || sr == nil {
+		return upstreamError(fmt.Sprintf("failed searching for %q", query), err)
+	}
+
+	results := SearchResults{
+		Fetched: time.Now(),
+	}
+	for _, view := range sr.Posts {
+		err = c.storePost(view)
+		if err != nil {
+			c.errLog.Println("failed to add post", view.Post.ID, err)
+			continue
+		}
+		results.PostIDs = append(results.PostIDs, view.Post.ID)
+	}
+	for _, view := range sr.Comments {
+		comment, err := c.newComment(view, view.Post.CreatorID)
+		if err != nil {
+			return err
+		}
+		results.Comments = append(results.Comments, comment)
+	}
+	for _, view := range sr.Communities {
+		results.Communities = append(results.Communities, Community{
+			ID:          view.Community.ID,
+			Name:        view.Community.Name,
+			Title:       view.Community.Title,
+			Description: view.Community.Description,
+		})
+	}
+	for _, view := range sr.Users {
+		results.Persons = append(results.Persons, Person{
+			ActorID: view.Person.ActorID,
+			Name:    view.Person.Name,
+			DisplayName: processPersonName(
+				view.Person,
+				view.IsAdmin,
+				false,
+				false,
+			),
+			Local:        view.Person.Local,
+			URL:          processPersonURL(view.Person),
+			CommentCount: view.Counts.CommentCount,
+			PostCount:    view.Counts.PostCount,
+		})
+	}
+
+	c.searches.set(
+		searchKey(query, searchType, community, page, sort),
+		results,
+	)
+	return nil
+}
+
+// searchKey is the key for a page of search results. The query and community
+// are quoted since they may contain anything.
+func searchKey(
+	query string,
+	searchType hb.SearchType,
+	community string,
+	page int,
+	sort hb.SortType,
+) string {
+	return strings.Join([]string{
+		strconv.Quote(query),
+		string(searchType),
+		strconv.Quote(community),
+		strconv.Itoa(page),
+		string(sort),
+	}, ":")
+}
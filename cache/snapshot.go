@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SNAPSHOT_VERSION is increased whenever the snapshot format or any of the
+// cached types change so that old snapshots, and entries stored by the disk
+// backend, are ignored rather than loaded incorrectly.
+const SNAPSHOT_VERSION = 3
+
+// snapshot is the on disk representation of a Cache.
+type snapshot struct {
+	Version int
+	Saved   time.Time
+
+	Home           []lruItem[string, Page]
+	Communities    []Community
+	CommunityPages []lruItem[string, Page]
+	Posts          []lruItem[int, Post]
+	Comments       []lruItem[string, PostComments]
+	Persons        []lruItem[string, Person]
+}
+
+// Save writes the contents of the cache to the snapshot file.
+// Nothing is done if the cache was not given a snapshot path.
+func (c *Cache) Save() error {
+	if c.snapshotPath == "" {
+		return nil
+	}
+
+	s := snapshot{
+		Version:        SNAPSHOT_VERSION,
+		Saved:          time.Now(),
+		Home:           c.home.cache.dump(),
+		Communities:    c.communities.getAll(),
+		CommunityPages: c.communities.pages.dump(),
+		Posts:          c.posts.cache.dump(),
+		Comments:       c.comments.cache.dump(),
+		Persons:        c.persons.cache.dump(),
+	}
+
+	// Write to a temporary file first so that a crash while saving never
+	// leaves a partial snapshot behind.
+	f, err := os.CreateTemp(filepath.Dir(c.snapshotPath), ".hex-snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed creating snapshot: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(s)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing snapshot: %v", err)
+	}
+
+	err = os.Rename(f.Name(), c.snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed saving snapshot: %v", err)
+	}
+	c.infoLog.Println("saved cache snapshot:", c.snapshotPath)
+	return nil
+}
+
+// load fills the cache with the contents of the snapshot file. It returns
+// false without an error if there is no snapshot to load.
+func (c *Cache) load() (bool, error) {
+	if c.snapshotPath == "" {
+		return false, nil
+	}
+
+	f, err := os.Open(c.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed opening snapshot: %v", err)
+	}
+	defer f.Close()
+
+	var s snapshot
+	err = gob.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return false, fmt.Errorf("failed reading snapshot: %v", err)
+	}
+	if s.Version != SNAPSHOT_VERSION {
+		return false, fmt.Errorf(
+			"ignoring snapshot with version %v, expected %v",
+			s.Version,
+			SNAPSHOT_VERSION,
+		)
+	}
+
+	c.home.cache.restore(s.Home)
+	for _, community := range s.Communities {
+		c.communities.set(community.Name, community)
+	}
+	c.communities.pages.restore(s.CommunityPages)
+	c.posts.cache.restore(s.Posts)
+	c.comments.cache.restore(s.Comments)
+	c.persons.cache.restore(s.Persons)
+
+	c.infoLog.Printf(
+		"loaded cache snapshot from %v saved %v\n",
+		c.snapshotPath,
+		s.Saved.Format(time.RFC3339),
+	)
+	return true, nil
+}
+
+// snapshotter periodically saves the cache to the snapshot file until the
+// cache is closed.
+func (c *Cache) snapshotter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		err := c.Save()
+		if err != nil {
+			c.errLog.Println(err)
+		}
+	}
+}
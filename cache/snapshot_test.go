@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/hex/hb"
+	"github.com/yuin/goldmark"
+)
+
+// newTestCache returns a cache which is ready to use but has nothing running
+// in the background.
+func newTestCache(t *testing.T, opts Options) *Cache {
+	t.Helper()
+	c := new(Cache)
+	c.infoLog = log.New(io.Discard, "", 0)
+	c.errLog = log.New(io.Discard, "", 0)
+	c.snapshotPath = opts.SnapshotPath
+	c.Reload(opts)
+	err := c.openStores(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.flights = newFlight()
+	c.markdown = goldmark.New()
+	c.emojiReplacer = strings.NewReplacer()
+	c.linkReplacer = strings.NewReplacer()
+	return c
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	c := newTestCache(t, Options{SnapshotPath: path})
+	c.posts.set(1, Post{ID: 1, Name: "first"})
+	c.posts.set(2, Post{ID: 2, Name: "second"})
+	c.home.set(1, hb.SortTypeActive, Page{PostIDs: []int{2, 1}})
+	c.communities.set("c", Community{Name: "c"})
+	err := c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestCache(t, Options{SnapshotPath: path})
+	ok, err := loaded.load()
+	if !ok || err != nil {
+		t.Fatalf("got %v, %v, want the snapshot loaded", ok, err)
+	}
+	if post, ok := loaded.posts.get(2); !ok || post.Name != "second" {
+		t.Errorf("got post %+v, %v, want the saved post", post, ok)
+	}
+	if page, ok := loaded.home.get(1, hb.SortTypeActive); !ok || len(page.PostIDs) != 2 {
+		t.Errorf("got home page %+v, %v, want the saved page", page, ok)
+	}
+	if _, ok := loaded.communities.get("c"); !ok {
+		t.Error("community wasn't loaded")
+	}
+	items := loaded.posts.cache.dump()
+	if len(items) != 2 || items[0].Key != 1 {
+		t.Errorf("got posts %v, want them in the saved order", items)
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		data    string
+		err     string
+	}{
+		{name: "older version", version: SNAPSHOT_VERSION - 1, err: "version"},
+		{name: "newer version", version: SNAPSHOT_VERSION + 1, err: "version"},
+		{name: "no version", version: 0, err: "version"},
+		{name: "corrupt", data: "not a snapshot", err: "failed reading"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.data != "" {
+				_, err = f.WriteString(tt.data)
+			} else {
+				err = gob.NewEncoder(f).Encode(snapshot{
+					Version: tt.version,
+					Saved:   time.Now(),
+					Posts: []lruItem[int, Post]{
+						{Key: 1, Value: Post{ID: 1}, Stored: time.Now()},
+					},
+				})
+			}
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := newTestCache(t, Options{SnapshotPath: path})
+			ok, err := c.load()
+			if ok || err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, %v, want an error about the %v", ok, err, tt.err)
+			}
+			if n := c.posts.cache.len(); n != 0 {
+				t.Errorf("got %d posts from a rejected snapshot, want none", n)
+			}
+		})
+	}
+}
+
+func TestSnapshotMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	c := newTestCache(t, Options{SnapshotPath: path})
+	ok, err := c.load()
+	if ok || err != nil {
+		t.Errorf("got %v, %v, want nothing loaded without an error", ok, err)
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Backends which can be used to store the cache.
+const (
+	// BackendMemory keeps the cache in memory. It's the default.
+	BackendMemory = "memory"
+
+	// BackendDisk keeps the cache in files within Options.Dir. Everything
+	// but the index of which entries exist is read from disk as needed.
+	BackendDisk = "disk"
+)
+
+// store is the storage behind each part of the cache.
+type store[K comparable, V any] interface {
+	// get returns the value for a key and marks it as recently used.
+	get(key K) (V, bool)
+
+	// set stores a value for a key, evicting the least recently used
+	// entries if the store is over its size limit.
+	set(key K, value V)
+
+	// remove deletes the entry for a key if it exists.
+	remove(key K)
+
+	// removeOlder deletes every entry which was stored longer than d ago and
+	// returns how many were deleted.
+	removeOlder(d time.Duration) int
+
+	// removeFunc deletes every entry whose key matches and returns how many
+	// were deleted.
+	removeFunc(match func(key K) bool) int
+
+	// len returns the number of entries.
+	len() int
+
+	// dump returns every entry ordered from least to most recently used.
+	dump() []lruItem[K, V]
+
+	// restore adds entries returned by dump, keeping their stored times and
+	// order. Existing entries with the same keys are replaced.
+	restore(items []lruItem[K, V])
+}
+
+var (
+	_ store[string, Page] = &lru[string, Page]{}
+	_ store[string, Page] = &diskStore[string, Page]{}
+)
+
+// newStore creates the storage for one part of the cache using the backend
+// selected in the options. The name is used to keep the parts separate in
+// backends which need it. A max of zero means no limit. Backends which can
+// fail log their errors to errLog.
+func newStore[K comparable, V any](
+	opts Options,
+	errLog *log.Logger,
+	name string,
+	max int,
+) (store[K, V], error) {
+	switch opts.Backend {
+	case "", BackendMemory:
+		return newLRU[K, V](max), nil
+	case BackendDisk:
+		if opts.Dir == "" {
+			return nil, fmt.Errorf("the %v backend requires a directory", BackendDisk)
+		}
+		return openDiskStore[K, V](
+			filepath.Join(opts.Dir, name),
+			max,
+			errLog,
+		)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %v", opts.Backend)
+	}
+}
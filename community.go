@@ -16,6 +16,7 @@ type communityPage struct {
 	Page     int
 	Posts    []cache.Post
 	Sort     string
+	Stale    bool
 }
 
 // community handles displaying the lists of posts for a specific community.
@@ -26,7 +27,7 @@ func (app *application) community(w http.ResponseWriter, r *http.Request) {
 		var err error
 		pageNum, err = strconv.Atoi(q.Get("page"))
 		if err != nil {
-			app.notFound(w)
+			app.notFound(w, r)
 			return
 		}
 	}
@@ -34,22 +35,24 @@ func (app *application) community(w http.ResponseWriter, r *http.Request) {
 
 	params := httprouter.ParamsFromContext(r.Context())
 	name := params.ByName("name")
-	community, err := app.cache.Community(app.client, name)
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	community, err := app.cache.Community(ctx, app.client, name)
 	if err != nil {
-		app.clientError(w, http.StatusNotFound) // TODO: Handle server errors vs notFound error.
+		app.cacheError(w, r, err)
 		return
 	}
 
-	page, err := app.cache.CommunityPosts(app.client, name, pageNum, sort)
+	page, err := app.cache.CommunityPosts(ctx, app.client, name, pageNum, sort)
 	if err != nil {
-		app.serverError(w, err)
+		app.cacheError(w, r, err)
 		return
 	}
 	var posts []cache.Post
 	for _, id := range page.PostIDs {
-		p, err := app.cache.Post(app.client, id)
+		p, err := app.cache.Post(ctx, app.client, id)
 		if err != nil {
-			app.serverError(w, err)
+			app.cacheError(w, r, err)
 			return
 		}
 		posts = append(posts, p)
@@ -61,6 +64,7 @@ func (app *application) community(w http.ResponseWriter, r *http.Request) {
 		Page:     pageNum,
 		Posts:    posts,
 		Sort:     string(sort),
+		Stale:    page.Stale,
 	})
 }
 
@@ -71,9 +75,11 @@ type communitiesPage struct {
 
 // communities handles displaying the community list page.
 func (app *application) communities(w http.ResponseWriter, r *http.Request) {
-	cms, err := app.cache.Communities()
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	cms, err := app.cache.Communities(ctx, app.client)
 	if err != nil {
-		app.serverError(w, err)
+		app.cacheError(w, r, err)
 		return
 	}
 	app.render(w, http.StatusOK, "communities.tmpl", communitiesPage{
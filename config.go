@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Default branding, used when an instance doesn't set its own.
+const (
+	TITLE       = "diet hexbear"
+	DESCRIPTION = "Hexbear, but for old and slower computers"
+)
+
+// config is the contents of the config file. It's a JSON object where the
+// instances key lists the instances served and every other key is a setting
+// named after its flag.
+type config struct {
+	// Settings are the value of each setting in the file, as they would be
+	// given as flags.
+	Settings map[string]string
+
+	// Instances are the Lemmy instances served. The first is the default,
+	// used for any request which doesn't match another. If there are none
+	// the hb setting is served as the only instance.
+	Instances []instanceConfig
+}
+
+// instanceConfig describes a Lemmy instance served by hex.
+type instanceConfig struct {
+	// Name identifies the instance. Its pages are served under /i/<name>/,
+	// over Gemini and Gopher as well as HTTP. Defaults to the hostname of HB.
+	Name string `json:"name"`
+
+	// HB is the base URL of the instance's API.
+	HB string `json:"hb"`
+
+	// Domain is where the instance's pages are served, used for absolute
+	// links and replacing links to the instance. Defaults to the first of
+	// Hosts, or the path prefix under the default domain.
+	Domain string `json:"domain"`
+
+	// Hosts are the hostnames which serve the instance at the root.
+	Hosts []string `json:"hosts"`
+
+	// Title and Description brand the instance's pages.
+	Title       string `json:"title"`
+	Description string `json:"description"`
+
+	// HexbearEmoji replaces hexbear's custom emoji with the embedded copies.
+	// The copies are of hexbear.net's emoji, so it's only useful for hexbear.
+	HexbearEmoji bool `json:"hexbear-emoji"`
+
+	// MOTD shows hexbear's messages of the day on the home page.
+	MOTD bool `json:"motd"`
+}
+
+// host returns the hostname of the instance's API without a leading www. so
+// that it names the instance and matches links with or without it.
+func (ic instanceConfig) host() string {
+	u, err := url.Parse(ic.HB)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// loadConfig reads a config file.
+func loadConfig(path string) (config, error) {
+	var cfg config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed reading config: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return cfg, fmt.Errorf("failed parsing config %v: %w", path, err)
+	}
+
+	cfg.Settings = make(map[string]string)
+	for name, raw := range fields {
+		if name == "instances" {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(&cfg.Instances)
+			if err != nil {
+				return cfg, fmt.Errorf("failed parsing instances in %v: %w", path, err)
+			}
+			continue
+		}
+		var value any
+		err = json.Unmarshal(raw, &value)
+		if err != nil {
+			return cfg, fmt.Errorf("failed parsing %q in %v: %w", name, path, err)
+		}
+		switch value := value.(type) {
+		case string:
+			cfg.Settings[name] = value
+		case float64, bool:
+			cfg.Settings[name] = string(raw)
+		default:
+			return cfg, fmt.Errorf(
+				"setting %q in %v must be a string, number, or boolean",
+				name,
+				path,
+			)
+		}
+	}
+	return cfg, nil
+}
+
+// fillInstances validates the instances and fills in their missing settings.
+// Without any instances the hb setting is used as the only one.
+func (cfg *config) fillInstances(s *settings) error {
+	domain := strings.TrimSuffix(s.domain, "/")
+	if len(cfg.Instances) == 0 {
+		cfg.Instances = []instanceConfig{{
+			HB:           s.hbURL,
+			Title:        s.title,
+			Description:  s.description,
+			HexbearEmoji: true,
+			MOTD:         true,
+		}}
+	}
+
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for i := range cfg.Instances {
+		ic := &cfg.Instances[i]
+		if ic.host() == "" {
+			return fmt.Errorf("instance %d has an invalid hb URL %q", i+1, ic.HB)
+		}
+		if ic.Name == "" {
+			ic.Name = ic.host()
+		}
+		if strings.Contains(ic.Name, "/") {
+			return fmt.Errorf("instance name %q contains a slash", ic.Name)
+		}
+		if names[ic.Name] {
+			return fmt.Errorf("instance name %q is used twice", ic.Name)
+		}
+		names[ic.Name] = true
+
+		for j, host := range ic.Hosts {
+			host = strings.ToLower(host)
+			if hosts[host] {
+				return fmt.Errorf("host %q is used twice", host)
+			}
+			hosts[host] = true
+			ic.Hosts[j] = host
+		}
+
+		switch {
+		case ic.Domain != "":
+		case i == 0:
+			ic.Domain = domain
+		case len(ic.Hosts) > 0:
+			ic.Domain = "https://" + ic.Hosts[0]
+		default:
+			ic.Domain = domain + INSTANCE_PREFIX + ic.Name
+		}
+		ic.Domain = strings.TrimSuffix(ic.Domain, "/")
+		// The default instance is branded by the title and description
+		// settings.
+		switch {
+		case ic.Title != "":
+		case i == 0:
+			ic.Title = s.title
+		default:
+			ic.Title = ic.Name
+		}
+		switch {
+		case ic.Description != "":
+		case i == 0:
+			ic.Description = s.description
+		default:
+			ic.Description = ic.Name + ", but for old and slower computers"
+		}
+	}
+	return nil
+}
@@ -121,3 +121,17 @@ func Since(start time.Time) string {
 func Date(t time.Time) string {
 	return t.Format("January 2, 2006")
 }
+
+// LocalURL turns links to pages on the instance at host, with or without
+// www., which can be read here into site relative links. Other links are
+// returned unchanged.
+func LocalURL(u string, host string) string {
+	for _, h := range []string{"https://" + host, "https://www." + host} {
+		for _, page := range []string{"/post/", "/comment/", "/c/", "/u/"} {
+			if strings.HasPrefix(u, h+page) {
+				return strings.TrimPrefix(u, h)
+			}
+		}
+	}
+	return u
+}
@@ -0,0 +1,61 @@
+package display
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+)
+
+// LinkFunc returns the text written for a link or image found in markdown,
+// given its destination and label. An image's label is its alt text, or
+// "image" if it has none.
+type LinkFunc func(url string, label string, image bool) string
+
+// InlineText returns the text of a markdown node's inline children, as used
+// to render markdown in formats without markup. Links and images are written
+// as returned by link and raw HTML is left out.
+func InlineText(n ast.Node, src []byte, link LinkFunc) string {
+	var b strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Text:
+			b.Write(c.Segment.Value(src))
+			if c.HardLineBreak() {
+				b.WriteString("\n")
+			} else if c.SoftLineBreak() {
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.Write(c.Value)
+		case *ast.CodeSpan:
+			b.WriteString("`" + InlineText(c, src, link) + "`")
+		case *ast.AutoLink:
+			b.WriteString(link(string(c.URL(src)), string(c.Label(src)), false))
+		case *ast.Link:
+			label := InlineText(c, src, link)
+			b.WriteString(link(string(c.Destination), label, false))
+		case *ast.Image:
+			alt := InlineText(c, src, link)
+			if alt == "" {
+				alt = "image"
+			}
+			b.WriteString(link(string(c.Destination), alt, true))
+		case *ast.RawHTML:
+		default:
+			b.WriteString(InlineText(c, src, link))
+		}
+	}
+	return b.String()
+}
+
+// CodeLines returns the lines of a code or HTML block without their line
+// endings.
+func CodeLines(n ast.Node, src []byte) []string {
+	lines := n.Lines()
+	code := make([]string, 0, lines.Len())
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code = append(code, strings.TrimRight(string(line.Value(src)), "\r\n"))
+	}
+	return code
+}
@@ -0,0 +1,42 @@
+package display
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// STALE is shown on pages which may be out of date.
+const STALE = "This page may be out of date."
+
+// MAX_PAGE is the last page which may be asked for. Each page deeper into a
+// listing costs more to fetch, and for comments every page before it too.
+const MAX_PAGE = 100
+
+// PositiveParam parses a positive integer no more than max from the query,
+// returning def if it's not set. False is returned if the parameter is set but
+// invalid.
+func PositiveParam(q url.Values, name string, def int, max int) (int, bool) {
+	if !q.Has(name) {
+		return def, true
+	}
+	n, err := strconv.Atoi(q.Get(name))
+	if err != nil || n < 1 || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// PageParam parses the page from the query, defaulting to the first.
+func PageParam(q url.Values) (int, bool) {
+	return PositiveParam(q, "page", 1, MAX_PAGE)
+}
+
+// PageURL returns a link to another page of the same query.
+func PageURL(q url.Values, page int) string {
+	next := make(url.Values, len(q))
+	for k, v := range q {
+		next[k] = v
+	}
+	next.Set("page", strconv.Itoa(page))
+	return "?" + next.Encode()
+}
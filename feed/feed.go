@@ -0,0 +1,170 @@
+// Package feed renders RSS and Atom feeds.
+package feed
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// Feed is a format independent description of a feed.
+type Feed struct {
+	Title       string
+	Link        string // Absolute URL of the page the feed is for.
+	Self        string // Absolute URL of the feed itself.
+	Description string
+	Updated     time.Time
+	Items       []Item
+}
+
+// Item is a single entry in a Feed.
+type Item struct {
+	Title     string
+	Link      string // Absolute URL, also used as the item's ID.
+	Author    string
+	Published time.Time
+	Updated   time.Time
+	Content   string // HTML.
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Self          rssLink   `xml:"atom:link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// RSS renders the feed as RSS 2.0.
+func (f Feed) RSS() ([]byte, error) {
+	doc := rss{
+		Version: "2.0",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title: f.Title,
+			Link:  f.Link,
+			Self: rssLink{
+				Href: f.Self,
+				Rel:  "self",
+				Type: "application/rss+xml",
+			},
+			Description:   f.Description,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, item := range f.Items {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			GUID:        rssGUID{IsPermaLink: true, Value: item.Link},
+			Creator:     item.Author,
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+			Description: item.Content,
+		})
+	}
+	return marshal(doc)
+}
+
+type atom struct {
+	XMLName xml.Name    `xml:"feed"`
+	NS      string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Link      atomLink    `xml:"link"`
+	Author    *atomAuthor `xml:"author"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Atom renders the feed as Atom 1.0.
+func (f Feed) Atom() ([]byte, error) {
+	doc := atom{
+		NS:      "http://www.w3.org/2005/Atom",
+		ID:      f.Self,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		// Entries without an author of their own fall back to this.
+		Author: atomAuthor{Name: f.Title},
+		Links: []atomLink{
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+			{Href: f.Self, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	for _, item := range f.Items {
+		entry := atomEntry{
+			ID:        item.Link,
+			Title:     item.Title,
+			Link:      atomLink{Href: item.Link},
+			Published: item.Published.UTC().Format(time.RFC3339),
+			Updated:   item.Updated.UTC().Format(time.RFC3339),
+			Content:   atomContent{Type: "html", Value: item.Content},
+		}
+		if item.Author != "" {
+			entry.Author = &atomAuthor{Name: item.Author}
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+	return marshal(doc)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/feed"
+	"git.sr.ht/~kota/hex/hb"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Feeds are served as RSS from feed.xml and as Atom from atom.xml.
+const (
+	RSS_FEED  = "feed.xml"
+	ATOM_FEED = "atom.xml"
+)
+
+// homeFeed handles the feed of posts on the home page.
+func (app *application) homeFeed(w http.ResponseWriter, r *http.Request) {
+	sort := hb.ParseSortType(r.URL.Query().Get("sort"))
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	page, err := app.cache.Home(ctx, app.client, 1, sort)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	items, err := app.postItems(ctx, page.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	app.serveFeed(w, r, feed.Feed{
+		Title:       app.title,
+		Link:        app.domain + "/",
+		Description: "Posts on " + app.instance,
+		Updated:     page.Fetched,
+		Items:       items,
+	})
+}
+
+// communityFeed handles the feed of posts in a community.
+func (app *application) communityFeed(w http.ResponseWriter, r *http.Request) {
+	sort := hb.ParseSortType(r.URL.Query().Get("sort"))
+	params := httprouter.ParamsFromContext(r.Context())
+	name := params.ByName("name")
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	community, err := app.cache.Community(ctx, app.client, name)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	page, err := app.cache.CommunityPosts(ctx, app.client, name, 1, sort)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	items, err := app.postItems(ctx, page.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	title := community.Title
+	if title == "" {
+		title = community.Name
+	}
+	app.serveFeed(w, r, feed.Feed{
+		Title:       title,
+		Link:        app.domain + "/c/" + community.Name,
+		Description: community.Description,
+		Updated:     page.Fetched,
+		Items:       items,
+	})
+}
+
+// userFeed handles the feed of posts made by a user. The posts are always
+// newest first, so a sort is refused rather than ignored.
+func (app *application) userFeed(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("sort") {
+		app.clientError(w, r, http.StatusBadRequest)
+		return
+	}
+	params := httprouter.ParamsFromContext(r.Context())
+	name := params.ByName("name")
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	user, err := app.cache.Person(ctx, app.client, name)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	items, err := app.postItems(ctx, user.PostIDs)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	app.serveFeed(w, r, feed.Feed{
+		Title:       user.DisplayName,
+		Link:        app.domain + "/u/" + name,
+		Description: "Posts by " + user.DisplayName,
+		Updated:     user.Fetched,
+		Items:       items,
+	})
+}
+
+// postFeed handles the feed of comments on a post.
+func (app *application) postFeed(w http.ResponseWriter, r *http.Request) {
+	sort := hb.ParseCommentSortType(r.URL.Query().Get("sort"))
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	post, err := app.cache.Post(ctx, app.client, id)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	comments, err := app.cache.Comments(ctx, app.client, id, sort, 0)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+
+	var items []feed.Item
+	var walk func([]*cache.Comment)
+	walk = func(cs []*cache.Comment) {
+		for _, c := range cs {
+			if !c.Missing {
+				updated := c.Published
+				if c.Updated != nil {
+					updated = *c.Updated
+				}
+				items = append(items, feed.Item{
+					Title:     "Comment by " + c.CreatorDisplayName,
+					Link:      app.domain + "/comment/" + strconv.Itoa(c.ID),
+					Author:    c.CreatorDisplayName,
+					Published: c.Published,
+					Updated:   updated,
+					Content:   app.absoluteLinks(string(c.Content)),
+				})
+			}
+			walk(c.Children)
+		}
+	}
+	walk(comments.Comments)
+
+	app.serveFeed(w, r, feed.Feed{
+		Title:       "Comments on " + post.Name,
+		Link:        app.domain + "/post/" + strconv.Itoa(post.ID),
+		Description: "Comments on " + post.Name,
+		Updated:     comments.Fetched,
+		Items:       items,
+	})
+}
+
+// postItems looks up posts and converts them into feed items.
+func (app *application) postItems(
+	ctx context.Context,
+	ids []int,
+) ([]feed.Item, error) {
+	var items []feed.Item
+	for _, id := range ids {
+		post, err := app.cache.Post(ctx, app.client, id)
+		if err != nil {
+			return nil, err
+		}
+
+		var content strings.Builder
+		if post.URL != "" {
+			fmt.Fprintf(
+				&content,
+				"<p><a href=\"%s\">%s</a></p>",
+				html.EscapeString(post.URL),
+				html.EscapeString(post.URL),
+			)
+		}
+		if post.Image != "" {
+			fmt.Fprintf(
+				&content,
+				"<p><img src=\"%s\" alt=\"Title Picture\"></p>",
+				html.EscapeString(post.Image),
+			)
+		}
+		content.WriteString(string(post.Body))
+
+		updated := post.Published
+		if post.Updated != nil {
+			updated = *post.Updated
+		}
+		items = append(items, feed.Item{
+			Title:     post.Name,
+			Link:      app.domain + "/post/" + strconv.Itoa(post.ID),
+			Author:    post.CreatorDisplayName,
+			Published: post.Published,
+			Updated:   updated,
+			Content:   app.absoluteLinks(content.String()),
+		})
+	}
+	return items, nil
+}
+
+// absoluteLinks makes site relative links in rendered HTML absolute, since
+// feed readers have no page to resolve them against.
+func (app *application) absoluteLinks(html string) string {
+	return strings.NewReplacer(
+		`href="/`, `href="`+app.domain+"/",
+		`src="/`, `src="`+app.domain+"/",
+	).Replace(html)
+}
+
+// serveFeed writes a feed in the format requested by the URL. The feed was
+// last modified when its data was fetched, and its ETag is a hash of the feed,
+// so that readers asking with If-Modified-Since or If-None-Match can be told
+// nothing has changed. The newest item can't be used since the feed changes
+// without it whenever posts are reordered or older ones are added.
+func (app *application) serveFeed(
+	w http.ResponseWriter,
+	r *http.Request,
+	f feed.Feed,
+) {
+	f.Self = app.domain + r.URL.RequestURI()
+
+	var data []byte
+	var err error
+	if strings.HasSuffix(r.URL.Path, "/"+ATOM_FEED) {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		data, err = f.Atom()
+	} else {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		data, err = f.RSS()
+	}
+	if err != nil {
+		app.serverError(w, r, fmt.Errorf("failed rendering feed: %v", err))
+		return
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", f.Updated, bytes.NewReader(data))
+}
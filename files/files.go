@@ -14,7 +14,10 @@ const baseTMPL = "base.tmpl"
 //go:embed "base.tmpl" "partials" "pages" "static" "emoji"
 var EFS embed.FS
 
-func Templates() (map[string]*template.Template, error) {
+// Templates parses each page along with the base template and partials. The
+// funcs are added to the defaults, they're used for things which differ
+// between instances such as the title.
+func Templates(funcs template.FuncMap) (map[string]*template.Template, error) {
 	cache := map[string]*template.Template{}
 
 	partials, err := fs.Glob(EFS, "partials/*.tmpl")
@@ -41,6 +44,7 @@ func Templates() (map[string]*template.Template, error) {
 				"Since":     display.Since,
 				"Date":      display.Date,
 			}).
+			Funcs(funcs).
 			ParseFS(EFS, files...)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,91 @@
+package gemini
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+)
+
+// CERT_LIFETIME is how long a generated certificate is valid for. Gemini
+// clients pin the first certificate they see, so it should rarely change.
+const CERT_LIFETIME = time.Hour * 24 * 365 * 10
+
+// loadCert loads the certificate and key from their files, creating a self
+// signed certificate for host if they don't exist yet. Without files the
+// certificate is only kept in memory.
+func loadCert(certFile, keyFile, host string) (tls.Certificate, bool, error) {
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			return cert, false, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return cert, false, fmt.Errorf("failed loading certificate: %v", err)
+		}
+	}
+
+	certPEM, keyPEM, err := newCert(host)
+	if err != nil {
+		return tls.Certificate{}, false, err
+	}
+	if certFile != "" && keyFile != "" {
+		err = os.WriteFile(keyFile, keyPEM, 0o600)
+		if err == nil {
+			err = os.WriteFile(certFile, certPEM, 0o644)
+		}
+		if err != nil {
+			return tls.Certificate{}, false, fmt.Errorf(
+				"failed saving certificate: %v",
+				err,
+			)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return cert, true, err
+}
+
+// newCert creates a PEM encoded self signed certificate and key for host.
+func newCert(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating serial number: %v", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CERT_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed encoding key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,338 @@
+// Package gemini serves hexbear over the Gemini protocol using the same cache
+// as the website.
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/hb"
+	"github.com/yuin/goldmark"
+)
+
+const (
+	// DEFAULT_ADDR is the standard Gemini port.
+	DEFAULT_ADDR = ":1965"
+
+	// REQUEST_TIMEOUT limits how long a client has to send its request.
+	REQUEST_TIMEOUT = time.Second * 30
+
+	// maxRequest is the longest URL allowed by the specification plus CRLF.
+	maxRequest = 1024 + 2
+)
+
+// Gemini response status codes.
+const (
+	statusSuccess          = 20
+	statusTemporaryFailure = 40
+	statusProxyError       = 43
+	statusSlowDown         = 44
+	statusNotFound         = 51
+	statusProxyRefused     = 53
+	statusBadRequest       = 59
+)
+
+// Server serves gemtext pages from the cache.
+type Server struct {
+	// Addr is the address to listen on, DEFAULT_ADDR if empty.
+	Addr string
+
+	// Host is the hostname used in a generated certificate.
+	Host string
+
+	// CertFile and KeyFile hold the TLS certificate. If they don't exist a
+	// self signed certificate is generated and saved to them.
+	CertFile string
+	KeyFile  string
+
+	Cache    *cache.Cache
+	Client   *hb.Client
+	Markdown goldmark.Markdown
+	InfoLog  *log.Logger
+	ErrLog   *log.Logger
+
+	// Instances are other Lemmy instances, keyed by the path prefix they're
+	// served under such as /i/name. Everything else is served from Cache.
+	Instances map[string]Instance
+
+	// UpstreamTimeout limits how long a request may wait on hexbear.
+	UpstreamTimeout time.Duration
+
+	// CommentDepth and CommentTop limit how deeply comments are nested and
+	// how many top level comments are shown on each page of a post.
+	CommentDepth int
+	CommentTop   int
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	conns    sync.WaitGroup
+}
+
+// Instance is a Lemmy instance served under a path prefix.
+type Instance struct {
+	Cache  *cache.Cache
+	Client *hb.Client
+}
+
+// site renders the pages of one instance. Its Cache and Client take the place
+// of the server's.
+type site struct {
+	*Server
+	Cache  *cache.Cache
+	Client *hb.Client
+}
+
+// ErrServerClosed is returned by ListenAndServe and Serve after Shutdown.
+var ErrServerClosed = errors.New("gemini: server closed")
+
+// ListenAndServe listens for Gemini requests and serves them until the
+// listener fails or the server is shut down.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DEFAULT_ADDR
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves Gemini requests from connections accepted by ln, which is
+// wrapped with TLS, until it fails or the server is shut down.
+func (s *Server) Serve(ln net.Listener) error {
+	cert, created, err := loadCert(s.CertFile, s.KeyFile, s.Host)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	if created {
+		s.InfoLog.Println("created gemini certificate for", s.Host)
+	}
+	ln = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+	defer ln.Close()
+
+	s.InfoLog.Println("starting gemini server on", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		// Connections are only tracked while open so Shutdown never waits
+		// on one accepted after it started.
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.conns.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits until those already
+// accepted are served or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	served := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// response is a Gemini response. The body is only sent on success.
+type response struct {
+	status int
+	meta   string
+	body   strings.Builder
+}
+
+// serve handles a single request on a connection.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(REQUEST_TIMEOUT))
+
+	res := new(response)
+	defer func() {
+		if err := recover(); err != nil {
+			s.ErrLog.Printf("%v\n%s", err, debug.Stack())
+			fmt.Fprintf(conn, "%d Internal error\r\n", statusTemporaryFailure)
+		}
+	}()
+
+	line, err := bufio.NewReader(io.LimitReader(conn, maxRequest)).
+		ReadString('\n')
+	if err != nil || !strings.HasSuffix(line, "\r\n") {
+		fmt.Fprintf(conn, "%d Bad request\r\n", statusBadRequest)
+		return
+	}
+	raw := strings.TrimSuffix(line, "\r\n")
+	s.InfoLog.Printf("%s - gemini %s", conn.RemoteAddr(), raw)
+
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		res.status = statusBadRequest
+		res.meta = "Bad request"
+	case u.Scheme != "gemini":
+		res.status = statusProxyRefused
+		res.meta = "Only gemini requests are served"
+	default:
+		// The request may wait on hexbear for longer than a client has
+		// to send it.
+		conn.SetDeadline(time.Now().Add(REQUEST_TIMEOUT + s.UpstreamTimeout))
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			s.UpstreamTimeout,
+		)
+		defer cancel()
+		s.route(ctx, res, u)
+	}
+
+	fmt.Fprintf(conn, "%d %s\r\n", res.status, res.meta)
+	if res.status == statusSuccess {
+		io.WriteString(conn, res.body.String())
+	}
+}
+
+// route renders the page for a URL, from the instance its path is under.
+func (s *Server) route(ctx context.Context, res *response, u *url.URL) {
+	res.status = statusSuccess
+	res.meta = "text/gemini; charset=utf-8"
+
+	path := u.Path
+	st := &site{Server: s, Cache: s.Cache, Client: s.Client}
+	var base string
+	for prefix, in := range s.Instances {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			path = strings.TrimPrefix(path, prefix)
+			st = &site{Server: s, Cache: in.Cache, Client: in.Client}
+			base = prefix
+			break
+		}
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var err error
+	switch {
+	case path == "" || path == "/":
+		err = st.home(ctx, res, u.Query())
+	case len(parts) == 1 && parts[0] == "communities":
+		err = st.communities(ctx, res)
+	case len(parts) == 2 && parts[0] == "c":
+		err = st.community(ctx, res, parts[1], u.Query())
+	case len(parts) == 2 && parts[0] == "post":
+		err = st.post(ctx, res, parts[1], 0, u.Query())
+	case len(parts) == 2 && parts[0] == "comment":
+		err = st.comment(ctx, res, parts[1], u.Query())
+	case len(parts) == 2 && parts[0] == "u":
+		err = st.user(ctx, res, parts[1])
+	default:
+		err = cache.ErrNotFound
+	}
+	if err != nil {
+		s.fail(res, err)
+		return
+	}
+	if base != "" {
+		body := addBase(res.body.String(), base)
+		res.body.Reset()
+		res.body.WriteString(body)
+	}
+}
+
+// addBase adds a base path to the site relative links in gemtext.
+func addBase(gemtext string, base string) string {
+	lines := strings.SplitAfter(gemtext, "\n")
+	var pre bool
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "```"):
+			pre = !pre
+		case !pre && strings.HasPrefix(line, "=> /") &&
+			!strings.HasPrefix(line, "=> //"):
+			lines[i] = "=> " + base + strings.TrimPrefix(line, "=> ")
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// fail sets the response status to match an error. Anything other than a
+// missing page is logged.
+func (s *Server) fail(res *response, err error) {
+	switch {
+	case errors.Is(err, cache.ErrNotFound):
+		res.status = statusNotFound
+		res.meta = "Not found"
+		return
+	case errors.Is(err, cache.ErrRateLimited):
+		res.status = statusSlowDown
+		res.meta = "10"
+	case errors.Is(err, cache.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		res.status = statusProxyError
+		res.meta = "Hexbear took too long to respond"
+	case errors.Is(err, cache.ErrUnavailable),
+		errors.Is(err, cache.ErrDecode):
+		res.status = statusProxyError
+		res.meta = "Hexbear is unavailable"
+	default:
+		res.status = statusTemporaryFailure
+		res.meta = "Internal error"
+	}
+	s.ErrLog.Output(2, err.Error())
+}
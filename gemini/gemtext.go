@@ -0,0 +1,121 @@
+package gemini
+
+import (
+	"strings"
+
+	"git.sr.ht/~kota/hex/display"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// link is a link found while converting markdown. Gemtext has no inline
+// links so they're listed after the block they were found in.
+type link struct {
+	url   string
+	label string
+}
+
+// gemtext converts markdown into gemtext.
+func (s *site) gemtext(markdown string) string {
+	src := []byte(markdown)
+	doc := s.Markdown.Parser().Parse(text.NewReader(src))
+
+	var b strings.Builder
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if n != doc.FirstChild() {
+			b.WriteString("\n")
+		}
+		writeBlock(&b, n, src, "", s.Cache.Host())
+	}
+	return b.String()
+}
+
+// writeBlock writes a block node as gemtext with each text line starting with
+// prefix. Links to pages on host are made site relative.
+func writeBlock(
+	b *strings.Builder,
+	n ast.Node,
+	src []byte,
+	prefix string,
+	host string,
+) {
+	switch n := n.(type) {
+	case *ast.Heading:
+		var links []link
+		text := strings.ReplaceAll(inline(n, src, &links), "\n", " ")
+		b.WriteString(strings.Repeat("#", min(n.Level, 3)) + " " + text + "\n")
+		writeLinks(b, links, host)
+	case *ast.Paragraph, *ast.TextBlock:
+		var links []link
+		for _, line := range strings.Split(inline(n, src, &links), "\n") {
+			b.WriteString(prefix + line + "\n")
+		}
+		writeLinks(b, links, host)
+	case *ast.List:
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			writeListItem(b, item, src, host)
+		}
+	case *ast.Blockquote:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			writeBlock(b, c, src, "> ", host)
+		}
+	case *ast.FencedCodeBlock, *ast.CodeBlock, *ast.HTMLBlock:
+		b.WriteString("```\n")
+		for _, line := range display.CodeLines(n, src) {
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("```\n")
+	case *ast.ThematicBreak:
+		b.WriteString("---\n")
+	default:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			writeBlock(b, c, src, prefix, host)
+		}
+	}
+}
+
+// writeListItem writes a list item as a single gemtext list line. Nested
+// lists are flattened since gemtext can't nest them.
+func writeListItem(b *strings.Builder, item ast.Node, src []byte, host string) {
+	var links []link
+	var parts []string
+	var nested []ast.Node
+	for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+		if _, ok := c.(*ast.List); ok {
+			nested = append(nested, c)
+			continue
+		}
+		parts = append(parts, strings.Fields(inline(c, src, &links))...)
+	}
+	b.WriteString("* " + strings.Join(parts, " ") + "\n")
+	writeLinks(b, links, host)
+	for _, list := range nested {
+		writeBlock(b, list, src, "", host)
+	}
+}
+
+// inline returns the text of a node's inline children, adding any links to
+// links.
+func inline(n ast.Node, src []byte, links *[]link) string {
+	return display.InlineText(
+		n,
+		src,
+		func(url string, label string, image bool) string {
+			*links = append(*links, link{url: url, label: label})
+			if image {
+				return ""
+			}
+			return label
+		},
+	)
+}
+
+func writeLinks(b *strings.Builder, links []link, host string) {
+	for _, l := range links {
+		b.WriteString("=> " + display.LocalURL(l.url, host))
+		if l.label != "" && l.label != l.url {
+			b.WriteString(" " + strings.ReplaceAll(l.label, "\n", " "))
+		}
+		b.WriteString("\n")
+	}
+}
@@ -0,0 +1,274 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/display"
+	"git.sr.ht/~kota/hex/hb"
+)
+
+// home renders the home page.
+func (s *site) home(ctx context.Context, res *response, q url.Values) error {
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return cache.ErrNotFound
+	}
+	sort := hb.ParseSortType(q.Get("sort"))
+	page, err := s.Cache.Home(ctx, s.Client, pageNum, sort)
+	if err != nil {
+		return err
+	}
+
+	b := &res.body
+	b.WriteString("# diet hexbear\n\n")
+	b.WriteString("=> /communities communities\n\n")
+	writeStale(b, page.Stale)
+	err = s.writePosts(ctx, b, page.PostIDs)
+	if err != nil {
+		return err
+	}
+	writePages(b, q, pageNum, len(page.PostIDs) > 0)
+	return nil
+}
+
+// communities renders the list of communities.
+func (s *site) communities(ctx context.Context, res *response) error {
+	cms, err := s.Cache.Communities(ctx, s.Client)
+	if err != nil {
+		return err
+	}
+
+	b := &res.body
+	b.WriteString("# communities\n\n")
+	for _, community := range cms {
+		fmt.Fprintf(b, "=> /c/%s %s\n", community.Name, community.Name)
+	}
+	return nil
+}
+
+// community renders a page of posts in a community.
+func (s *site) community(
+	ctx context.Context,
+	res *response,
+	name string,
+	q url.Values,
+) error {
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return cache.ErrNotFound
+	}
+	sort := hb.ParseSortType(q.Get("sort"))
+	community, err := s.Cache.Community(ctx, s.Client, name)
+	if err != nil {
+		return err
+	}
+	page, err := s.Cache.CommunityPosts(ctx, s.Client, name, pageNum, sort)
+	if err != nil {
+		return err
+	}
+
+	b := &res.body
+	fmt.Fprintf(b, "# %s\n\n", community.Name)
+	if community.Description != "" {
+		b.WriteString(s.gemtext(community.Description))
+		b.WriteString("\n")
+	}
+	writeStale(b, page.Stale)
+	err = s.writePosts(ctx, b, page.PostIDs)
+	if err != nil {
+		return err
+	}
+	writePages(b, q, pageNum, len(page.PostIDs) > 0)
+	return nil
+}
+
+// post renders a post along with a page of its comments. If commentID is set
+// only that comment's thread is shown.
+func (s *site) post(
+	ctx context.Context,
+	res *response,
+	id string,
+	commentID int,
+	q url.Values,
+) error {
+	postID, err := strconv.Atoi(id)
+	if err != nil || postID < 1 {
+		return cache.ErrNotFound
+	}
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return cache.ErrNotFound
+	}
+	sort := hb.ParseCommentSortType(q.Get("sort"))
+	post, err := s.Cache.Post(ctx, s.Client, postID)
+	if err != nil {
+		return err
+	}
+
+	var comments cache.PostComments
+	if commentID == 0 {
+		roots := pageNum * s.CommentTop
+		comments, err = s.Cache.Comments(ctx, s.Client, postID, sort, roots)
+	} else {
+		comments, err = s.Cache.Thread(ctx, s.Client, postID, commentID, sort)
+	}
+	if err != nil {
+		return err
+	}
+
+	b := &res.body
+	fmt.Fprintf(b, "# %s\n\n", post.Name)
+	fmt.Fprintf(
+		b,
+		"%d bears by %s %s in %s\n",
+		post.Upvotes,
+		post.CreatorDisplayName,
+		display.Since(post.Published),
+		post.CommunityName,
+	)
+	fmt.Fprintf(b, "=> /c/%s %s\n", post.CommunityName, post.CommunityName)
+	if post.URL != "" {
+		fmt.Fprintf(b, "=> %s %s\n", display.LocalURL(post.URL, s.Cache.Host()), post.URL)
+	}
+	if post.Image != "" {
+		fmt.Fprintf(b, "=> %s image\n", post.Image)
+	}
+	writeStale(b, post.Stale || comments.Stale)
+	if post.BodyMarkdown != "" {
+		b.WriteString("\n")
+		b.WriteString(s.gemtext(post.BodyMarkdown))
+	}
+
+	b.WriteString("\n## comments\n\n")
+	if commentID != 0 {
+		fmt.Fprintf(b, "=> /post/%d view full thread\n\n", post.ID)
+	}
+	roots, more := comments.Page(pageNum, s.CommentTop)
+	for _, comment := range roots.Limit(s.CommentDepth) {
+		s.writeComment(b, comment, 0)
+	}
+	writePages(b, q, pageNum, more)
+	return nil
+}
+
+// comment renders the thread for a single comment.
+func (s *site) comment(
+	ctx context.Context,
+	res *response,
+	id string,
+	q url.Values,
+) error {
+	commentID, err := strconv.Atoi(id)
+	if err != nil || commentID < 1 {
+		return cache.ErrNotFound
+	}
+	postID, err := s.Cache.CommentPost(ctx, s.Client, commentID)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, res, strconv.Itoa(postID), commentID, q)
+}
+
+// user renders a user and their posts.
+func (s *site) user(ctx context.Context, res *response, name string) error {
+	user, err := s.Cache.Person(ctx, s.Client, name)
+	if err != nil {
+		return err
+	}
+
+	b := &res.body
+	fmt.Fprintf(b, "# %s\n\n", user.DisplayName)
+	if user.BioMarkdown != "" {
+		b.WriteString(s.gemtext(user.BioMarkdown))
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(
+		b,
+		"%d comments - %d posts\nJoined %s on %s.\n\n",
+		user.CommentCount,
+		user.PostCount,
+		display.Since(user.Published),
+		display.Date(user.Published),
+	)
+	writeStale(b, user.Stale)
+	return s.writePosts(ctx, b, user.PostIDs)
+}
+
+// writePosts writes a link to each post followed by a line about it.
+func (s *site) writePosts(
+	ctx context.Context,
+	b *strings.Builder,
+	ids []int,
+) error {
+	for _, id := range ids {
+		post, err := s.Cache.Post(ctx, s.Client, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "=> /post/%d %s\n", post.ID, post.Name)
+		fmt.Fprintf(
+			b,
+			"%d bears %d comments by %s %s in %s\n\n",
+			post.Upvotes,
+			post.CommentCount,
+			post.CreatorDisplayName,
+			display.Since(post.Published),
+			post.CommunityName,
+		)
+	}
+	return nil
+}
+
+// writeComment writes a comment followed by its replies. Gemtext can't be
+// indented so the depth of each comment is shown in its heading instead.
+func (s *site) writeComment(b *strings.Builder, c *cache.Comment, depth int) {
+	marker := strings.Repeat("» ", depth)
+	if c.Missing {
+		fmt.Fprintf(b, "### %sparent comment not loaded\n\n", marker)
+	} else {
+		fmt.Fprintf(
+			b,
+			"### %s%s · %d bears · %s\n",
+			marker,
+			c.CreatorDisplayName,
+			c.Upvotes,
+			display.Since(c.Published),
+		)
+		b.WriteString(s.gemtext(c.ContentMarkdown))
+		fmt.Fprintf(b, "=> /comment/%d link\n\n", c.ID)
+	}
+	for _, child := range c.Children {
+		s.writeComment(b, child, depth+1)
+	}
+	if c.MoreReplies > 0 {
+		fmt.Fprintf(
+			b,
+			"=> /comment/%d %s» %d more replies, continue thread\n\n",
+			c.ID,
+			marker,
+			c.MoreReplies,
+		)
+	}
+}
+
+// writeStale notes when the page may be out of date.
+func writeStale(b *strings.Builder, stale bool) {
+	if stale {
+		b.WriteString(display.STALE + "\n\n")
+	}
+}
+
+// writePages writes links to the surrounding pages.
+func writePages(b *strings.Builder, q url.Values, page int, more bool) {
+	if page > 1 {
+		fmt.Fprintf(b, "=> %s previous page\n", display.PageURL(q, page-1))
+	}
+	if more && page < display.MAX_PAGE {
+		fmt.Fprintf(b, "=> %s next page\n", display.PageURL(q, page+1))
+	}
+}
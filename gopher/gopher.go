@@ -0,0 +1,308 @@
+// Package gopher serves hexbear over the Gopher protocol using the plain text
+// pages rendered from the cache.
+package gopher
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/plain"
+)
+
+const (
+	// DEFAULT_ADDR is the standard Gopher port.
+	DEFAULT_ADDR = ":70"
+
+	// REQUEST_TIMEOUT limits how long a client has to send its selector.
+	REQUEST_TIMEOUT = time.Second * 30
+
+	// maxRequest is the longest selector line read from a client.
+	maxRequest = 1024
+)
+
+// Server serves gophermaps of the plain text pages.
+type Server struct {
+	// Addr is the address to listen on, DEFAULT_ADDR if empty.
+	Addr string
+
+	// Host and Port are where clients are told to find menu items. They
+	// should be how the server is reached from outside.
+	Host string
+	Port int
+
+	Renderer *plain.Renderer
+	InfoLog  *log.Logger
+	ErrLog   *log.Logger
+
+	// Instances render other Lemmy instances, keyed by the selector prefix
+	// they're served under such as /i/name. Everything else is rendered by
+	// Renderer.
+	Instances map[string]*plain.Renderer
+
+	// UpstreamTimeout limits how long a request may wait on hexbear.
+	UpstreamTimeout time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	conns    sync.WaitGroup
+}
+
+// ErrServerClosed is returned by ListenAndServe and Serve after Shutdown.
+var ErrServerClosed = errors.New("gopher: server closed")
+
+// ListenAndServe listens for Gopher requests and serves them until the
+// listener fails or the server is shut down.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DEFAULT_ADDR
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves Gopher requests from connections accepted by ln until it fails
+// or the server is shut down.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+	defer ln.Close()
+
+	s.InfoLog.Println("starting gopher server on", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		// Connections are only tracked while open so Shutdown never waits
+		// on one accepted after it started.
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.conns.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits until those already
+// accepted are served or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	served := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serve handles a single request on a connection.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(REQUEST_TIMEOUT))
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	defer func() {
+		if err := recover(); err != nil {
+			s.ErrLog.Printf("%v\n%s", err, debug.Stack())
+			s.writeError(w, "Internal error")
+		}
+	}()
+
+	line, err := bufio.NewReader(io.LimitReader(conn, maxRequest)).
+		ReadString('\n')
+	if err != nil {
+		s.writeError(w, "Bad request")
+		return
+	}
+	// Gopher+ clients may send more fields after the selector.
+	selector, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), "\t")
+	s.InfoLog.Printf("%s - gopher %s", conn.RemoteAddr(), selector)
+
+	// The request may wait on hexbear for longer than a client has to send
+	// it.
+	conn.SetDeadline(time.Now().Add(REQUEST_TIMEOUT + s.UpstreamTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), s.UpstreamTimeout)
+	defer cancel()
+
+	r, base, selector := s.instance(selector)
+	doc, err := s.route(ctx, r, selector)
+	if err != nil {
+		s.writeError(w, s.fail(err))
+		return
+	}
+	s.writeMenu(w, doc, base)
+}
+
+// instance returns the renderer for the instance a selector is under along
+// with the instance's selector prefix and the rest of the selector.
+func (s *Server) instance(selector string) (*plain.Renderer, string, string) {
+	for prefix, r := range s.Instances {
+		if selector == prefix || strings.HasPrefix(selector, prefix+"/") ||
+			strings.HasPrefix(selector, prefix+"?") {
+			return r, prefix, strings.TrimPrefix(selector, prefix)
+		}
+	}
+	return s.Renderer, "", selector
+}
+
+// route renders the page for a selector.
+func (s *Server) route(
+	ctx context.Context,
+	r *plain.Renderer,
+	selector string,
+) (*plain.Doc, error) {
+	path, query, _ := strings.Cut(selector, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, cache.ErrNotFound
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "" || path == "/":
+		return r.Home(ctx, q)
+	case len(parts) == 2 && parts[0] == "c":
+		return r.Community(ctx, parts[1], q)
+	case len(parts) == 2 && parts[0] == "post":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 1 {
+			return nil, cache.ErrNotFound
+		}
+		return r.Post(ctx, id, 0, q)
+	case len(parts) == 2 && parts[0] == "comment":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 1 {
+			return nil, cache.ErrNotFound
+		}
+		return r.Comment(ctx, id, q)
+	case len(parts) == 2 && parts[0] == "u":
+		return r.User(ctx, parts[1])
+	default:
+		return nil, cache.ErrNotFound
+	}
+}
+
+// fail returns the message shown for an error. Anything other than a
+// missing page is logged.
+func (s *Server) fail(err error) string {
+	switch {
+	case errors.Is(err, cache.ErrNotFound):
+		return "Not found"
+	case errors.Is(err, cache.ErrRateLimited):
+		s.ErrLog.Output(2, err.Error())
+		return "Too many requests, try again soon"
+	case errors.Is(err, cache.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		s.ErrLog.Output(2, err.Error())
+		return "Hexbear took too long to respond"
+	case errors.Is(err, cache.ErrUnavailable),
+		errors.Is(err, cache.ErrDecode):
+		s.ErrLog.Output(2, err.Error())
+		return "Hexbear is unavailable"
+	default:
+		s.ErrLog.Output(2, err.Error())
+		return "Internal error"
+	}
+}
+
+// writeMenu writes a document as a gophermap. The text becomes info lines
+// and each reference a menu item after it, with base added to local ones.
+func (s *Server) writeMenu(w io.Writer, doc *plain.Doc, base string) {
+	for _, line := range doc.Lines {
+		s.writeItem(w, 'i', line, "", "error.host", 1)
+	}
+	if len(doc.Refs) > 0 {
+		s.writeItem(w, 'i', "", "", "error.host", 1)
+		s.writeItem(w, 'i', "References:", "", "error.host", 1)
+	}
+	for i, ref := range doc.Refs {
+		display := "[" + strconv.Itoa(i+1) + "] " + ref
+		if plain.IsLocal(ref) {
+			s.writeItem(w, '1', display, base+ref, s.Host, s.Port)
+			continue
+		}
+		s.writeItem(w, 'h', display, "URL:"+ref, s.Host, s.Port)
+	}
+	io.WriteString(w, ".\r\n")
+}
+
+// writeError writes a gophermap holding only an error.
+func (s *Server) writeError(w io.Writer, msg string) {
+	s.writeItem(w, '3', msg, "", "error.host", 1)
+	io.WriteString(w, ".\r\n")
+}
+
+// writeItem writes a single gophermap line. Tabs and line breaks can't
+// appear in any field so they are replaced with spaces.
+func (s *Server) writeItem(
+	w io.Writer,
+	kind byte,
+	display string,
+	selector string,
+	host string,
+	port int,
+) {
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	fmt.Fprintf(
+		w,
+		"%c%s\t%s\t%s\t%d\r\n",
+		kind,
+		clean.Replace(display),
+		clean.Replace(selector),
+		host,
+		port,
+	)
+}
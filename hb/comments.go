@@ -40,13 +40,27 @@ type CommentListResp struct {
 	Comments []CommentView `json:"comments"`
 }
 
+// CommentResp is the response from Comment.
+type CommentResp struct {
+	CommentView CommentView `json:"comment_view"`
+}
+
 // CommentList is used to get some or all comments associated with a post.
+//
+// When maxDepth is set, comments are returned as a tree nested at most that
+// many levels deep. Lemmy then ignores page and limit and returns at most 300
+// comments. Otherwise page and limit apply to every comment regardless of
+// depth. Setting parentID returns only that comment and its replies, in which
+// case maxDepth is counted from the parent.
 func (c *Client) CommentList(
 	ctx context.Context,
 	page int,
 	limit int,
 	postID int,
+	parentID int,
+	maxDepth int,
 	sortType CommentSortType,
+	listingType ListingType,
 ) (*CommentListResp, *http.Response, error) {
 	u := c.BaseURL.JoinPath("comment/list")
 	q := u.Query()
@@ -59,12 +73,38 @@ func (c *Client) CommentList(
 	if postID != 0 {
 		q.Add("post_id", strconv.Itoa(postID))
 	}
+	if parentID != 0 {
+		q.Add("parent_id", strconv.Itoa(parentID))
+	}
+	if maxDepth != 0 {
+		q.Add("max_depth", strconv.Itoa(maxDepth))
+	}
 	if sortType != "" {
 		q.Add("sort", string(sortType))
 	}
+	if listingType != "" {
+		q.Add("type_", string(listingType))
+	}
 	u.RawQuery = q.Encode()
 
 	comments := new(CommentListResp)
 	resp, err := c.Do(ctx, u, comments)
 	return comments, resp, err
 }
+
+// Comment fetches a single comment.
+func (c *Client) Comment(
+	ctx context.Context,
+	id int,
+) (*CommentResp, *http.Response, error) {
+	u := c.BaseURL.JoinPath("comment")
+	q := u.Query()
+	if id != 0 {
+		q.Add("id", strconv.Itoa(id))
+	}
+	u.RawQuery = q.Encode()
+
+	comment := new(CommentResp)
+	resp, err := c.Do(ctx, u, comment)
+	return comment, resp, err
+}
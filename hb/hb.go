@@ -4,12 +4,15 @@ package hb
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // BaseURL is the default URL for the hexbear API.
@@ -21,73 +24,222 @@ type Client struct {
 	BaseURL    *url.URL
 
 	debugLog *log.Logger
+	retry    RetryPolicy
+
+	// maxResponseBytes is the largest response body accepted, zero for no
+	// limit.
+	maxResponseBytes int64
+
+	// limiter and slots limit how many requests are made per second and how
+	// many may be in flight at once. Either may be nil for no limit.
+	limiter  *limiter
+	slots    chan struct{}
+	inFlight atomic.Int64
+	waiting  atomic.Int64
 }
 
-// NewClient constructs a client using http.DefaultClient and the default
-// base URL. The returned client is ready for use.
-func NewClient(baseURL string, debugLog *log.Logger) (*Client, error) {
+// NewClient constructs a client using the given base URL and an HTTP client
+// configured by DefaultTransportPolicy. The returned client is ready for use.
+func NewClient(
+	baseURL string,
+	debugLog *log.Logger,
+	opts ...Option,
+) (*Client, error) {
 	var c Client
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return &c, err
 	}
-	c.HTTPClient = http.DefaultClient
+	c.HTTPClient = newHTTPClient(DefaultTransportPolicy)
+	c.maxResponseBytes = DefaultTransportPolicy.MaxResponseBytes
 	c.BaseURL = u
 	c.debugLog = debugLog
+	c.retry = DefaultRetryPolicy
+	c.limiter = newLimiter(DefaultRateLimit, DefaultBurst)
+	c.slots = make(chan struct{}, DefaultMaxInFlight)
+	for _, opt := range opts {
+		opt(&c)
+	}
 	return &c, nil
 }
 
-// StatusError is returned when a bad response code is received from the API.
-type StatusError struct {
-	Code int
+// APIError is returned when a bad response code is received from the API.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Err is the error key from lemmy's JSON error body, such as
+	// "couldnt_find_post". It's empty if no such body was sent.
+	Err string
+
+	// URL is the URL which was requested.
+	URL string
+
+	// RetryAfter is how long the API asked us to wait before trying again.
+	// It's zero if no Retry-After header was sent.
+	RetryAfter time.Duration
+}
+
+var _ error = &APIError{}
+
+func (e *APIError) Error() string {
+	if e.Err != "" {
+		return fmt.Sprintf(
+			"bad response status code: %d: %s: %s",
+			e.StatusCode,
+			e.Err,
+			e.URL,
+		)
+	}
+	return fmt.Sprintf("bad response status code: %d: %s", e.StatusCode, e.URL)
+}
+
+// IsNotFound reports if the API said the requested object does not exist.
+// Lemmy often uses a 400 status with a couldnt_find_* error key for this.
+func (e *APIError) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound ||
+		strings.HasPrefix(e.Err, "couldnt_find") ||
+		e.Err == "not_found"
+}
+
+// IsRateLimited reports if the API refused the request due to rate limiting.
+func (e *APIError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.Err == "rate_limit_error"
 }
 
-var _ error = StatusError{}
+// IsServerError reports if the API failed due to an error on its end.
+func (e *APIError) IsServerError() bool {
+	return e.StatusCode >= 500
+}
+
+// IsNotFound reports if err is an APIError saying the requested object does
+// not exist.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.IsNotFound()
+}
 
-func (e StatusError) Error() string {
-	return fmt.Sprintf("bad response status code: %d", e.Code)
+// IsRateLimited reports if err is an APIError caused by rate limiting.
+func IsRateLimited(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.IsRateLimited()
 }
 
 // Do sends an API request and returns the API response.
 // The API response is JSON decoded and stored in the value pointed to by v, or
 // returned as an error if an API error has occurred.
 // If v is nil, and no error happens, the response is returned as is.
+//
+// Requests which fail due to network errors, server errors, or rate limiting
+// are retried according to the client's RetryPolicy.
 func (c *Client) Do(
 	ctx context.Context,
 	u *url.URL,
 	v interface{},
 ) (*http.Response, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+	method := http.MethodGet
+	for attempt := 1; ; attempt++ {
+		resp, err := c.do(ctx, method, u, v)
+		if err == nil ||
+			attempt >= c.retry.MaxAttempts ||
+			!retryable(ctx, method, err) {
+			return resp, err
+		}
+
+		delay := c.retry.backoff(attempt)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			// Waiting longer than we're willing to is just giving up slowly.
+			if apiErr.RetryAfter > c.retry.MaxDelay {
+				return resp, err
+			}
+			delay = apiErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+
+		c.debugLog.Printf("retrying %v in %v: %v", u.String(), delay, err)
+		if sleep(ctx, delay) != nil {
+			return resp, err
+		}
+	}
+}
+
+// do makes a single attempt at an API request.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	v interface{},
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build request: %v", err)
 	}
-	req = req.WithContext(ctx)
+
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
 
 	c.debugLog.Println("requesting:", u.String())
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to do request: %v", err)
+		return nil, &requestError{err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, StatusError{Code: resp.StatusCode}
+		return nil, newAPIError(resp)
 	}
 
-	switch v := v.(type) {
-	case nil:
-	default:
-		decErr := json.NewDecoder(resp.Body).Decode(v)
-		if decErr == io.EOF {
-			decErr = nil // ignore EOF errors caused by empty response body
-		}
-		if decErr != nil {
-			err = decErr
-		}
+	if v == nil {
+		return resp, nil
+	}
+	// Read one byte past the limit to tell a body which fits exactly from one
+	// which was cut off.
+	var body io.Reader = resp.Body
+	if c.maxResponseBytes > 0 {
+		body = io.LimitReader(resp.Body, c.maxResponseBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		// The body failing part way, such as when the client times out, is a
+		// transport failure just like the request failing.
+		return nil, &requestError{err: err}
+	}
+	if c.maxResponseBytes > 0 && int64(len(data)) > c.maxResponseBytes {
+		return nil, fmt.Errorf(
+			"response from %v exceeds %d bytes",
+			u.Redacted(),
+			c.maxResponseBytes,
+		)
 	}
+	if len(data) == 0 {
+		return resp, nil // ignore empty response bodies
+	}
+	err = json.Unmarshal(data, v)
 	return resp, err
 }
 
+// newAPIError builds an APIError from a bad response.
+// Lemmy describes most errors with a small JSON body. It's fine if the body is
+// missing or isn't JSON, we'll just have the status code.
+func newAPIError(resp *http.Response) *APIError {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Err:        body.Error,
+		URL:        resp.Request.URL.String(),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
 // ListingType is used when filtering a listing.
 type ListingType string
 
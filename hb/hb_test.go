@@ -0,0 +1,172 @@
+package hb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a test server running handler and the
+// URL to request from it. Retries are quick and there's no rate limit unless
+// opts say otherwise.
+func newTestClient(
+	t *testing.T,
+	handler http.HandlerFunc,
+	opts ...Option,
+) (*Client, *url.URL) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	opts = append([]Option{
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    time.Second,
+		}),
+		WithRateLimit(0, 0),
+	}, opts...)
+	c, err := NewClient(srv.URL+"/api/v3/", log.New(io.Discard, "", 0), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, c.BaseURL.JoinPath("post")
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name        string
+		reply       reply
+		err         string
+		notFound    bool
+		rateLimited bool
+		retryAfter  time.Duration
+	}{
+		{
+			name:     "not found",
+			reply:    reply{status: http.StatusNotFound},
+			notFound: true,
+		},
+		{
+			name: "couldnt find",
+			reply: reply{
+				status: http.StatusBadRequest,
+				body:   `{"error":"couldnt_find_post"}`,
+			},
+			err:      "couldnt_find_post",
+			notFound: true,
+		},
+		{
+			name: "rate limited",
+			reply: reply{
+				status:     http.StatusBadRequest,
+				body:       `{"error":"rate_limit_error"}`,
+				retryAfter: "2",
+			},
+			err:         "rate_limit_error",
+			rateLimited: true,
+			retryAfter:  time.Second * 2,
+		},
+		{
+			name:  "not json",
+			reply: reply{status: http.StatusBadGateway, body: "<html>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n atomic.Int32
+			c, u := newTestClient(
+				t,
+				replies(&n, tt.reply),
+				WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+			)
+			var v struct{}
+			_, err := c.Do(context.Background(), u, &v)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want an APIError", err)
+			}
+			if apiErr.StatusCode != tt.reply.status ||
+				apiErr.Err != tt.err ||
+				apiErr.IsNotFound() != tt.notFound ||
+				apiErr.IsRateLimited() != tt.rateLimited ||
+				apiErr.RetryAfter != tt.retryAfter {
+				t.Errorf("got %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	body := `{"name":"0123456789"}`
+	tests := []struct {
+		name string
+		max  int64
+		fail bool
+	}{
+		{name: "no limit", max: 0},
+		{name: "fits", max: int64(len(body))},
+		{name: "too large", max: int64(len(body)) - 1, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n atomic.Int32
+			policy := DefaultTransportPolicy
+			policy.MaxResponseBytes = tt.max
+			c, u := newTestClient(
+				t,
+				replies(&n, reply{status: http.StatusOK, body: body}),
+				WithTransportPolicy(policy),
+			)
+			var v struct{ Name string }
+			_, err := c.Do(context.Background(), u, &v)
+			if !tt.fail {
+				if err != nil || v.Name != "0123456789" {
+					t.Errorf("got %+v, %v, want the decoded body", v, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "exceeds") {
+				t.Errorf("got %v, want the response to exceed the limit", err)
+			}
+			if got := n.Load(); got != 1 {
+				t.Errorf("made %d attempts, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRetryBodyReadError(t *testing.T) {
+	var n atomic.Int32
+	c, u := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 1 {
+			// Send part of the body then stall past the client's timeout.
+			w.Write([]byte(`{"name":`))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`{"name":"ok"}`))
+	})
+	c.HTTPClient.Timeout = time.Millisecond * 100
+
+	var v struct{ Name string }
+	_, err := c.Do(context.Background(), u, &v)
+	if err != nil || v.Name != "ok" {
+		t.Errorf("got %+v, %v, want the body from the retry", v, err)
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("made %d attempts, want 2", got)
+	}
+}
@@ -0,0 +1,195 @@
+package hb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRateLimit is the default number of requests per second a client
+	// will make.
+	DefaultRateLimit = 5
+
+	// DefaultBurst is the default number of requests a client may make at once
+	// before DefaultRateLimit is applied.
+	DefaultBurst = 10
+
+	// DefaultMaxInFlight is the default number of requests a client may have
+	// in progress at the same time.
+	DefaultMaxInFlight = 8
+)
+
+// WithRateLimit limits the client to making rate requests per second with
+// bursts of up to burst requests. A rate of zero or less disables the limit.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(c *Client) {
+		c.limiter = newLimiter(rate, burst)
+	}
+}
+
+// WithMaxInFlight limits the client to n requests in progress at the same
+// time. Zero or less disables the limit.
+func WithMaxInFlight(n int) Option {
+	return func(c *Client) {
+		c.slots = nil
+		if n > 0 {
+			c.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// Stats describes the current state of a client's request limits.
+type Stats struct {
+	// InFlight is the number of requests currently in progress.
+	InFlight int64
+	// MaxInFlight is the limit for InFlight or zero if there is none.
+	MaxInFlight int
+	// Waiting is the number of requests waiting for the rate limit or for a
+	// free slot.
+	Waiting int64
+	// Tokens is the number of requests which could be made right now without
+	// waiting on the rate limit. It's negative when requests are queued.
+	Tokens float64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"in flight %d/%d, waiting %d, tokens %.1f",
+		s.InFlight,
+		s.MaxInFlight,
+		s.Waiting,
+		s.Tokens,
+	)
+}
+
+// Stats returns the current state of the client's request limits.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		InFlight:    c.inFlight.Load(),
+		MaxInFlight: cap(c.slots),
+		Waiting:     c.waiting.Load(),
+	}
+	if c.limiter != nil {
+		s.Tokens = c.limiter.available()
+	}
+	return s
+}
+
+// acquire waits until the rate limit and in flight limit allow another
+// request to be made. If the context is done first its error is returned. A
+// successful acquire must be followed by a call to release.
+func (c *Client) acquire(ctx context.Context) error {
+	start := time.Now()
+	c.waiting.Add(1)
+	defer c.waiting.Add(-1)
+
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return fmt.Errorf("waiting for rate limit: %w", err)
+		}
+	}
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			// No request is made, so the rate limit token is given back.
+			if c.limiter != nil {
+				c.limiter.cancel()
+			}
+			return fmt.Errorf("waiting for request slot: %w", ctx.Err())
+		}
+	}
+	c.inFlight.Add(1)
+
+	if waited := time.Since(start); waited > time.Millisecond*10 {
+		c.debugLog.Printf("waited %v to make request: %v", waited, c.Stats())
+	}
+	return nil
+}
+
+// release frees the request slot taken by acquire.
+func (c *Client) release() {
+	c.inFlight.Add(-1)
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// limiter is a token bucket rate limiter.
+type limiter struct {
+	mutex  sync.Mutex
+	rate   float64 // Tokens added per second.
+	burst  float64 // Maximum number of tokens.
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last refill.
+// The mutex must be held.
+func (l *limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// available returns the number of tokens currently in the bucket.
+func (l *limiter) available() float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	return l.tokens
+}
+
+// wait reserves a token and waits until it is available. If the context would
+// be done before then, the token is returned and an error is given instead.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+	l.refill(now)
+	l.tokens--
+	tokens := l.tokens
+	l.mutex.Unlock()
+
+	if tokens >= 0 {
+		return nil
+	}
+	delay := time.Duration(-tokens / l.rate * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		l.cancel()
+		return context.DeadlineExceeded
+	}
+	if err := sleep(ctx, delay); err != nil {
+		l.cancel()
+		return err
+	}
+	return nil
+}
+
+// cancel returns a reserved token which was not used.
+func (l *limiter) cancel() {
+	l.mutex.Lock()
+	l.tokens++
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mutex.Unlock()
+}
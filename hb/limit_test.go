@@ -0,0 +1,136 @@
+package hb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	if l := newLimiter(0, 10); l != nil {
+		t.Error("got a limiter for a rate of zero, want none")
+	}
+
+	l := newLimiter(10, 2)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond*50 {
+		t.Errorf("burst waited %v, want no wait", waited)
+	}
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < time.Millisecond*80 {
+		t.Errorf("request after the burst waited %v, want about 100ms", waited)
+	}
+}
+
+func TestLimiterDeadline(t *testing.T) {
+	l := newLimiter(1, 1)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	err := l.wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Millisecond*50 {
+		t.Errorf("waited %v for a token it couldn't get in time", waited)
+	}
+	if tokens := l.available(); tokens < -0.1 {
+		t.Errorf("got %.2f tokens, want the reserved token returned", tokens)
+	}
+}
+
+// blocking returns a handler which blocks until release is closed, tracking
+// the most requests it has handled at once in peak.
+func blocking(release chan struct{}, peak *atomic.Int32) http.HandlerFunc {
+	var current atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		w.Write([]byte(`{}`))
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	var peak atomic.Int32
+	c, u := newTestClient(t, blocking(release, &peak), WithMaxInFlight(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var v struct{}
+			_, err := c.Do(context.Background(), u, &v)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 100)
+	if s := c.Stats(); s.InFlight != 2 || s.Waiting != 3 {
+		t.Errorf("got %v, want 2 in flight and 3 waiting", s)
+	}
+	close(release)
+	wg.Wait()
+
+	if p := peak.Load(); p != 2 {
+		t.Errorf("server saw %d requests at once, want 2", p)
+	}
+	if s := c.Stats(); s.InFlight != 0 || s.Waiting != 0 {
+		t.Errorf("got %v after all requests finished, want none", s)
+	}
+}
+
+func TestSlotTimeoutReturnsToken(t *testing.T) {
+	release := make(chan struct{})
+	var peak atomic.Int32
+	c, u := newTestClient(
+		t,
+		blocking(release, &peak),
+		WithMaxInFlight(1),
+		WithRateLimit(1, 2),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var v struct{}
+		c.Do(context.Background(), u, &v)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	var v struct{}
+	_, err := c.Do(ctx, u, &v)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if s := c.Stats(); s.Tokens < 0.9 {
+		t.Errorf("got %v, want the token for the failed request returned", s)
+	}
+	close(release)
+	<-done
+}
@@ -15,6 +15,7 @@ type Post struct {
 	URL               string     `json:"url"`
 	Body              string     `json:"body"`
 	CommunityID       int        `json:"community_id"`
+	CreatorID         int        `json:"creator_id"`
 	Published         time.Time  `json:"published"`
 	Updated           *time.Time `json:"updated"`
 	FeaturedLocal     bool       `json:"featured_local"`
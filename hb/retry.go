@@ -0,0 +1,132 @@
+package hb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests are retried.
+// Only GET requests are retried and only when they failed due to a network
+// error, a server error, or rate limiting.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for a request,
+	// including the first one. Values below 1 are treated as 1.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. Each following retry
+	// doubles the delay up to MaxDelay. The delays are randomly jittered so
+	// that many failed requests are not all retried at the same moment.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used by clients unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond * 500,
+	MaxDelay:    time.Second * 10,
+}
+
+// Option configures a Client in NewClient.
+type Option func(*Client)
+
+// WithRetryPolicy sets the retry policy used by the client.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// backoff returns the jittered delay before a given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Wait somewhere between half and all of the delay.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports if a request which failed with err should be tried again.
+func retryable(ctx context.Context, method string, err error) bool {
+	if method != http.MethodGet || ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// Lemmy may report rate limiting with a 400 status.
+		if apiErr.IsRateLimited() {
+			return true
+		}
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var reqErr *requestError
+	return errors.As(err, &reqErr)
+}
+
+// requestError is returned when a request could not be made at all, such as
+// when the connection was refused or timed out.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return "failed to do request: " + e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses the value of a Retry-After header which may either
+// be a number of seconds or a date. Zero is returned if it's missing or
+// invalid.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
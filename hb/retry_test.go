@@ -0,0 +1,205 @@
+package hb
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		BaseDelay: time.Millisecond * 100,
+		MaxDelay:  time.Second,
+	}
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{retry: 1, max: time.Millisecond * 100},
+		{retry: 2, max: time.Millisecond * 200},
+		{retry: 3, max: time.Millisecond * 400},
+		{retry: 4, max: time.Millisecond * 800},
+		{retry: 5, max: time.Second},
+		{retry: 50, max: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := p.backoff(tt.retry)
+			if d < tt.max/2 || d > tt.max {
+				t.Fatalf(
+					"backoff(%d) = %v, want between %v and %v",
+					tt.retry,
+					d,
+					tt.max/2,
+					tt.max,
+				)
+			}
+		}
+	}
+	if d := (RetryPolicy{}).backoff(1); d != 0 {
+		t.Errorf("backoff without a delay = %v, want 0", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "3", want: time.Second * 3},
+		{value: "-1", want: 0},
+		{value: "soon", want: 0},
+		{value: "Mon, 02 Jan 2006 15:04:05 GMT", want: 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	got := parseRetryAfter(date)
+	if got <= time.Second*50 || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about a minute", date, got)
+	}
+}
+
+// reply is a response sent by a test server.
+type reply struct {
+	status     int
+	body       string
+	retryAfter string
+}
+
+// replies returns a handler sending each reply in turn, repeating the last,
+// and counting requests in n.
+func replies(n *atomic.Int32, rs ...reply) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		i := int(n.Add(1)) - 1
+		rep := rs[min(i, len(rs)-1)]
+		if rep.retryAfter != "" {
+			w.Header().Set("Retry-After", rep.retryAfter)
+		}
+		w.WriteHeader(rep.status)
+		w.Write([]byte(rep.body))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ok := reply{status: http.StatusOK, body: `{}`}
+	tests := []struct {
+		name     string
+		replies  []reply
+		attempts int32
+		fail     bool
+	}{
+		{
+			name:     "success",
+			replies:  []reply{ok},
+			attempts: 1,
+		},
+		{
+			name:     "server error",
+			replies:  []reply{{status: http.StatusServiceUnavailable}, ok},
+			attempts: 2,
+		},
+		{
+			name:     "gives up",
+			replies:  []reply{{status: http.StatusInternalServerError}},
+			attempts: 3,
+			fail:     true,
+		},
+		{
+			name:     "not found",
+			replies:  []reply{{status: http.StatusNotFound}},
+			attempts: 1,
+			fail:     true,
+		},
+		{
+			name: "bad request",
+			replies: []reply{{
+				status: http.StatusBadRequest,
+				body:   `{"error":"couldnt_find_post"}`,
+			}},
+			attempts: 1,
+			fail:     true,
+		},
+		{
+			name: "rate limited with 400",
+			replies: []reply{{
+				status: http.StatusBadRequest,
+				body:   `{"error":"rate_limit_error"}`,
+			}, ok},
+			attempts: 2,
+		},
+		{
+			name: "retry after too long",
+			replies: []reply{{
+				status:     http.StatusTooManyRequests,
+				retryAfter: "5",
+			}},
+			attempts: 1,
+			fail:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n atomic.Int32
+			c, u := newTestClient(t, replies(&n, tt.replies...))
+			var v struct{}
+			_, err := c.Do(context.Background(), u, &v)
+			if (err != nil) != tt.fail {
+				t.Errorf("got error %v, want failure %v", err, tt.fail)
+			}
+			if got := n.Load(); got != tt.attempts {
+				t.Errorf("made %d attempts, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var n atomic.Int32
+	c, u := newTestClient(t, replies(
+		&n,
+		reply{status: http.StatusTooManyRequests, retryAfter: "1"},
+		reply{status: http.StatusOK, body: `{}`},
+	))
+	start := time.Now()
+	var v struct{}
+	_, err := c.Do(context.Background(), u, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %v, want at least 1s", waited)
+	}
+	if got := n.Load(); got != 2 {
+		t.Errorf("made %d attempts, want 2", got)
+	}
+}
+
+func TestRetryAfterPastDeadline(t *testing.T) {
+	var n atomic.Int32
+	c, u := newTestClient(t, replies(
+		&n,
+		reply{status: http.StatusServiceUnavailable, retryAfter: "1"},
+	))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	var v struct{}
+	_, err := c.Do(ctx, u, &v)
+	if err == nil {
+		t.Fatal("got no error, want the server error")
+	}
+	if waited := time.Since(start); waited > time.Millisecond*100 {
+		t.Errorf("gave up after %v, want it to not wait for the retry", waited)
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("made %d attempts, want 1", got)
+	}
+}
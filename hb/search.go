@@ -0,0 +1,85 @@
+package hb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SearchType selects which kinds of results are returned by Search.
+type SearchType string
+
+const (
+	SearchTypeAll         SearchType = "All"
+	SearchTypePosts       SearchType = "Posts"
+	SearchTypeComments    SearchType = "Comments"
+	SearchTypeCommunities SearchType = "Communities"
+	SearchTypeUsers       SearchType = "Users"
+)
+
+const DefaultSearchType = SearchTypeAll
+
+func ParseSearchType(s string) SearchType {
+	s = strings.ToLower(s)
+	switch s {
+	case "all":
+		return SearchTypeAll
+	case "posts":
+		return SearchTypePosts
+	case "comments":
+		return SearchTypeComments
+	case "communities":
+		return SearchTypeCommunities
+	case "users":
+		return SearchTypeUsers
+	default:
+		return DefaultSearchType
+	}
+}
+
+// SearchResp is the response from Search. Only the lists matching the type of
+// search are filled.
+type SearchResp struct {
+	Type        SearchType      `json:"type_"`
+	Comments    []CommentView   `json:"comments"`
+	Posts       []PostView      `json:"posts"`
+	Communities []CommunityView `json:"communities"`
+	Users       []PersonView    `json:"users"`
+}
+
+// Search finds posts, comments, communities, and users matching a query.
+// Results can be limited to a single community by giving its name.
+func (c *Client) Search(
+	ctx context.Context,
+	query string,
+	searchType SearchType,
+	communityName string,
+	page int,
+	limit int,
+	sortType SortType,
+) (*SearchResp, *http.Response, error) {
+	u := c.BaseURL.JoinPath("search")
+	q := u.Query()
+	q.Add("q", query)
+	if searchType != "" {
+		q.Add("type_", string(searchType))
+	}
+	if communityName != "" {
+		q.Add("community_name", communityName)
+	}
+	if page != 0 {
+		q.Add("page", strconv.Itoa(page))
+	}
+	if limit != 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if sortType != "" {
+		q.Add("sort", string(sortType))
+	}
+	u.RawQuery = q.Encode()
+
+	search := new(SearchResp)
+	resp, err := c.Do(ctx, u, search)
+	return search, resp, err
+}
@@ -0,0 +1,80 @@
+package hb
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportPolicy configures the HTTP client used to reach the API.
+type TransportPolicy struct {
+	// Timeout limits each attempt at a request, including reading the
+	// response body. Zero means no limit beyond the request's context.
+	Timeout time.Duration
+
+	// DialTimeout, TLSHandshakeTimeout, and ResponseHeaderTimeout limit
+	// connecting, the TLS handshake, and waiting for the response headers.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an unused connection is kept open.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConns limits the connections kept open for reuse and
+	// MaxConnsPerHost limits the connections open at once. Zero means no
+	// limit.
+	MaxIdleConns    int
+	MaxConnsPerHost int
+
+	// MaxResponseBytes is the largest response body accepted. Requests with
+	// larger responses fail. Zero means no limit.
+	MaxResponseBytes int64
+}
+
+// DefaultTransportPolicy is used by clients unless another is given with
+// WithTransportPolicy.
+var DefaultTransportPolicy = TransportPolicy{
+	Timeout:               time.Second * 30,
+	DialTimeout:           time.Second * 5,
+	TLSHandshakeTimeout:   time.Second * 5,
+	ResponseHeaderTimeout: time.Second * 15,
+	IdleConnTimeout:       time.Second * 90,
+	MaxIdleConns:          16,
+	MaxConnsPerHost:       32,
+	MaxResponseBytes:      16 << 20,
+}
+
+// WithTransportPolicy sets the timeouts and connection limits of the HTTP
+// client used by the client.
+func WithTransportPolicy(p TransportPolicy) Option {
+	return func(c *Client) {
+		c.HTTPClient = newHTTPClient(p)
+		c.maxResponseBytes = p.MaxResponseBytes
+	}
+}
+
+// newHTTPClient returns an HTTP client with its own transport configured by
+// the policy.
+func newHTTPClient(p TransportPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   p.DialTimeout,
+		KeepAlive: time.Second * 30,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   p.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       p.IdleConnTimeout,
+		MaxIdleConns:          p.MaxIdleConns,
+		MaxIdleConnsPerHost:   p.MaxIdleConns,
+		MaxConnsPerHost:       p.MaxConnsPerHost,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   p.Timeout,
+	}
+}
@@ -1,29 +1,113 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/plain"
 )
 
-// serverError writes to the error log and writes a StatusInternalServerError to
-// the client.
-func (app *application) serverError(w http.ResponseWriter, err error) {
+type errorPage struct {
+	CSPNonce   string
+	Status     int
+	StatusText string
+}
+
+// serverError writes to the error log and renders a StatusInternalServerError
+// page to the client.
+func (app *application) serverError(
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	app.errLog.Output(2, trace)
-	http.Error(
-		w,
-		http.StatusText(http.StatusInternalServerError),
-		http.StatusInternalServerError,
-	)
+	app.errorPage(w, r, http.StatusInternalServerError)
+}
+
+// clientError renders an error page with a particular status code to the
+// client.
+func (app *application) clientError(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+) {
+	app.errorPage(w, r, status)
+}
+
+// notFound renders a 404 page to the client.
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.clientError(w, r, http.StatusNotFound)
+}
+
+// cacheError renders an error page with a status code matching an error
+// returned from the cache. Anything other than a missing page is logged.
+func (app *application) cacheError(
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	switch {
+	case errors.Is(err, cache.ErrNotFound):
+		app.notFound(w, r)
+	case errors.Is(err, cache.ErrRateLimited):
+		app.errLog.Output(2, err.Error())
+		app.errorPage(w, r, http.StatusServiceUnavailable)
+	case errors.Is(err, cache.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		app.errLog.Output(2, err.Error())
+		app.errorPage(w, r, http.StatusGatewayTimeout)
+	case errors.Is(err, cache.ErrUnavailable),
+		errors.Is(err, cache.ErrDecode):
+		app.errLog.Output(2, err.Error())
+		app.errorPage(w, r, http.StatusBadGateway)
+	case errors.Is(err, context.Canceled):
+		// The client went away, there's nobody to show the error to.
+		app.errorPage(w, r, http.StatusServiceUnavailable)
+	default:
+		app.serverError(w, r, err)
+	}
 }
 
-// clientError returns a particular error code and message to the client.
-func (app *application) clientError(w http.ResponseWriter, status int) {
-	http.Error(w, http.StatusText(status), status)
+// upstreamContext returns a context for cache calls made while handling a
+// request. It's done when the client goes away or the upstream timeout is
+// reached, whichever comes first.
+func (app *application) upstreamContext(
+	r *http.Request,
+) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), app.upstreamTimeout)
 }
 
-// notFound returns a 404 to the client.
-func (app *application) notFound(w http.ResponseWriter) {
-	app.clientError(w, http.StatusNotFound)
+// errorPage renders the error template for a given status code. API
+// requests are given a JSON error and plain text requests a line of text
+// instead.
+func (app *application) errorPage(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+) {
+	if isAPI(r) {
+		app.writeJSON(w, r, status, apiError{
+			Version: API_VERSION,
+			Status:  status,
+			Error:   http.StatusText(status),
+		})
+		return
+	}
+	if isText(r) {
+		app.writeText(w, r, status, &plain.Doc{
+			Lines: []string{strconv.Itoa(status) + " " + http.StatusText(status)},
+		})
+		return
+	}
+	app.render(w, status, "error.tmpl", errorPage{
+		CSPNonce:   nonce(r.Context()),
+		Status:     status,
+		StatusText: http.StatusText(status),
+	})
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"strconv"
 
@@ -16,32 +17,39 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 		var err error
 		pageNum, err = strconv.Atoi(q.Get("page"))
 		if err != nil {
-			app.notFound(w)
+			app.notFound(w, r)
 			return
 		}
 	}
 	sort := hb.ParseSortType(q.Get("sort"))
 
-	page, err := app.cache.Home(app.client, pageNum, sort)
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	page, err := app.cache.Home(ctx, app.client, pageNum, sort)
 	if err != nil {
-		app.serverError(w, err)
+		app.cacheError(w, r, err)
 		return
 	}
 	var posts []cache.Post
 	for _, id := range page.PostIDs {
-		p, err := app.cache.Post(app.client, id)
+		p, err := app.cache.Post(ctx, app.client, id)
 		if err != nil {
-			app.serverError(w, err)
+			app.cacheError(w, r, err)
 			return
 		}
 		posts = append(posts, p)
 	}
 
+	var motd template.HTML
+	if app.motd {
+		motd = hb.GetMOTD()
+	}
 	app.render(w, http.StatusOK, "community.tmpl", communityPage{
 		CSPNonce: nonce(r.Context()),
-		Message:  hb.GetMOTD(),
+		Message:  motd,
 		Page:     pageNum,
 		Posts:    posts,
 		Sort:     string(sort),
+		Stale:    page.Stale,
 	})
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	"git.sr.ht/~kota/hex/files"
+)
+
+// INSTANCE_PREFIX is the path prefix under which each instance is served,
+// followed by its name.
+const INSTANCE_PREFIX = "/i/"
+
+// instanceMux sends each request to the application for its instance, chosen
+// by the INSTANCE_PREFIX path or the Host header. Anything else goes to the
+// default instance.
+type instanceMux struct {
+	fallback http.Handler
+	hosts    map[string]http.Handler
+	prefixes map[string]http.Handler
+}
+
+func newInstanceMux(fallback http.Handler) *instanceMux {
+	return &instanceMux{
+		fallback: fallback,
+		hosts:    make(map[string]http.Handler),
+		prefixes: make(map[string]http.Handler),
+	}
+}
+
+// handlePrefix serves an instance's application under its path prefix.
+func (m *instanceMux) handlePrefix(name string, h http.Handler) {
+	m.prefixes[name] = http.StripPrefix(INSTANCE_PREFIX+name, h)
+}
+
+// handleHost serves an instance's application for requests to a host.
+func (m *instanceMux) handleHost(host string, h http.Handler) {
+	m.hosts[strings.ToLower(host)] = h
+}
+
+func (m *instanceMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, INSTANCE_PREFIX); ok {
+		name, _, found := strings.Cut(rest, "/")
+		if h, ok := m.prefixes[name]; ok {
+			if !found {
+				u := *r.URL
+				u.Path += "/"
+				http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := m.hosts[strings.ToLower(host)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	m.fallback.ServeHTTP(w, r)
+}
+
+// handler parses the templates for the application's instance and returns
+// its routes.
+func (app *application) handler() (http.Handler, error) {
+	templates, err := files.Templates(app.templateFuncs())
+	if err != nil {
+		return nil, err
+	}
+	app.templates = templates
+	return app.routes(), nil
+}
+
+// templateFuncs returns the template functions for the application's
+// instance.
+func (app *application) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"Base":        func() string { return app.base },
+		"Link":        app.link,
+		"Title":       func() string { return app.title },
+		"Description": func() string { return app.description },
+		"Instance":    func() string { return app.instance },
+	}
+}
+
+// link adds the application's base path to site relative links.
+func (app *application) link(u string) string {
+	if strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+		return app.base + u
+	}
+	return u
+}
@@ -2,28 +2,22 @@ package main
 
 import "strings"
 
-func newLinkReplacer(domain string) *strings.Replacer {
-	linkReplacer := strings.NewReplacer(
-		"https://hexbear.net/communities",
-		domain+"/communities",
-		"https://www.hexbear.net/communities",
-		domain+"/communities",
-		"https://hexbear.net/ppb",
-		domain+"/ppb",
-		"https://www.hexbear.net/ppb",
-		domain+"/ppb",
-		"https://hexbear.net/post/",
-		domain+"/post/",
-		"https://www.hexbear.net/post/",
-		domain+"/post/",
-		"https://hexbear.net/c/",
-		domain+"/c/",
-		"https://www.hexbear.net/c/",
-		domain+"/c/",
-		"https://hexbear.net/u/",
-		domain+"/u/",
-		"https://www.hexbear.net/u/",
-		domain+"/u/",
-	)
-	return linkReplacer
+// newLinkReplacer returns a replacer which turns links to pages on an
+// instance into links to the same pages served under domain. The host is the
+// instance's hostname, links with and without www. are replaced.
+func newLinkReplacer(domain, host string) *strings.Replacer {
+	var oldnew []string
+	for _, h := range []string{host, "www." + host} {
+		for _, path := range []string{
+			"/communities",
+			"/ppb",
+			"/post/",
+			"/comment/",
+			"/c/",
+			"/u/",
+		} {
+			oldnew = append(oldnew, "https://"+h+path, domain+path)
+		}
+	}
+	return strings.NewReplacer(oldnew...)
 }
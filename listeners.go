@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Names of the listeners which can be passed to hex. Listeners without a name
+// are used in this order.
+var LISTENER_NAMES = []string{"http", "gemini", "gopher"}
+
+// LISTEN_FDS_START is the first file descriptor passed in the systemd style.
+const LISTEN_FDS_START = 3
+
+// listeners holds the listeners hex serves on, keyed by name.
+type listeners struct {
+	inherited map[string]net.Listener
+	open      map[string]net.Listener
+}
+
+// inheritListeners returns the listeners passed to the process with the
+// LISTEN_FDS and LISTEN_FDNAMES environment variables, as is done by systemd
+// socket activation. The variables are unset so they aren't passed on.
+func inheritListeners() (*listeners, error) {
+	ls := &listeners{
+		inherited: make(map[string]net.Listener),
+		open:      make(map[string]net.Listener),
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return ls, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return ls, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if !slices.Contains(LISTENER_NAMES, name) && i < len(LISTENER_NAMES) {
+			name = LISTENER_NAMES[i]
+		}
+		if _, ok := ls.inherited[name]; ok || !slices.Contains(LISTENER_NAMES, name) {
+			return nil, fmt.Errorf("unexpected listener %d named %q", i, name)
+		}
+
+		fd := LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed using inherited listener %v: %w", name, err)
+		}
+		ls.inherited[name] = ln
+	}
+	return ls, nil
+}
+
+// listen returns the inherited listener with a name, or listens on addr if
+// there isn't one.
+func (ls *listeners) listen(name, addr string) (net.Listener, error) {
+	ln, ok := ls.inherited[name]
+	if !ok {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ls.open[name] = ln
+	return ln, nil
+}
+
+// closeUnused closes the inherited listeners which weren't used.
+func (ls *listeners) closeUnused() {
+	for name, ln := range ls.inherited {
+		if _, ok := ls.open[name]; !ok {
+			ln.Close()
+		}
+	}
+}
@@ -1,48 +1,111 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
+	"time"
 
 	"git.sr.ht/~kota/hex/cache"
 	"git.sr.ht/~kota/hex/files"
+	"git.sr.ht/~kota/hex/gemini"
+	"git.sr.ht/~kota/hex/gopher"
 	"git.sr.ht/~kota/hex/hb"
+	"git.sr.ht/~kota/hex/plain"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
 )
 
 // DOMAIN is the domain name this server is assumed to be hosted under.
 // It's only really used for replacing hexbear links within the site.
-// It can be overwritten with a launch flag.
+// It can be overwritten with a launch flag or in the config file.
 const DOMAIN = "https://diethex.net"
 
+// SHUTDOWN_TIMEOUT is the default limit on how long open requests and
+// background fetches are waited on when shutting down.
+const SHUTDOWN_TIMEOUT = time.Second * 30
+
+// Defaults for the HTTP server's limits, so slow or idle clients can't hold
+// connections open forever. WRITE_TIMEOUT includes waiting on hexbear.
+const (
+	READ_HEADER_TIMEOUT = time.Second * 5
+	READ_TIMEOUT        = time.Second * 10
+	WRITE_TIMEOUT       = time.Second * 30
+	IDLE_TIMEOUT        = time.Second * 120
+	MAX_HEADER_BYTES    = 1 << 16
+)
+
 type application struct {
 	infoLog *log.Logger
 	errLog  *log.Logger
 
+	// live holds the settings which can change while running.
+	live *live
+
 	client    *hb.Client
 	cache     *cache.Cache
 	templates map[string]*template.Template
+
+	// text renders the plain text versions of pages.
+	text *plain.Renderer
+
+	// domain is used to create absolute links, such as those in feeds.
+	domain string
+
+	// base is the path the instance is served under, empty when it's
+	// served at the root.
+	base string
+
+	// instance names the Lemmy instance, title and description brand its
+	// pages.
+	instance    string
+	title       string
+	description string
+
+	// motd shows a message of the day on the home page.
+	motd bool
+
+	// upstreamTimeout limits how long a request may wait on hexbear.
+	upstreamTimeout time.Duration
+
+	// commentDepth and commentTop are the default limits on how deeply
+	// comments are nested and how many top level comments are shown on each
+	// page of a post. commentMaxDepth and commentMaxTop are the most which
+	// may be asked for.
+	commentDepth    int
+	commentTop      int
+	commentMaxDepth int
+	commentMaxTop   int
 }
 
 func main() {
-	addr := flag.String("addr", ":4000", "HTTP network address")
-	hbURL := flag.String("hb", hb.BaseURL, "hexbear baseURL")
-	domain := flag.String("domain", DOMAIN, "domain name for link replacement")
-	flag.Parse()
+	s, cfg, err := loadSettings(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	infoLog := log.New(os.Stdout, "INFO ", log.Ldate|log.Ltime)
 	debugLog := log.New(os.Stdout, "DEBUG ", log.Ldate|log.Ltime)
 	errLog := log.New(os.Stderr, "ERROR ", log.Ldate|log.Ltime|log.Lshortfile)
-
-	templates, err := files.Templates()
-	if err != nil {
-		errLog.Fatal(err)
-	}
+	live := new(live)
+	applyLive(s, live, infoLog, debugLog, errLog)
 
 	markdown := goldmark.New(
 		goldmark.WithExtensions(
@@ -56,45 +119,329 @@ func main() {
 		),
 	)
 
-	emojiReplacer := strings.NewReplacer(files.Emojis()...)
-	linkReplacer := newLinkReplacer(*domain)
+	var mux *instanceMux
+	var caches []*cache.Cache
+	var defaultClient *hb.Client
+	var defaultText *plain.Renderer
+	// Gemini and Gopher serve each instance under its path prefix.
+	geminiInstances := make(map[string]gemini.Instance)
+	gopherInstances := make(map[string]*plain.Renderer)
+	for _, ic := range cfg.Instances {
+		emojiReplacer := strings.NewReplacer()
+		if ic.HexbearEmoji {
+			emojiReplacer = strings.NewReplacer(files.Emojis()...)
+		}
+		linkReplacer := newLinkReplacer(ic.Domain, ic.host())
 
-	cli, err := hb.NewClient(*hbURL, debugLog)
-	if err != nil {
-		errLog.Fatalf(
-			"failed creating hexbear client %v",
-			err,
+		cli, err := hb.NewClient(
+			ic.HB,
+			debugLog,
+			hb.WithRetryPolicy(hb.RetryPolicy{
+				MaxAttempts: s.retries,
+				BaseDelay:   s.retryDelay,
+				MaxDelay:    s.retryMaxDelay,
+			}),
+			hb.WithRateLimit(s.rateLimit, s.burst),
+			hb.WithMaxInFlight(s.maxInFlight),
+			hb.WithTransportPolicy(s.transportPolicy()),
 		)
-	}
-	cache, err := cache.Initialize(
-		cli,
-		infoLog,
-		errLog,
-		markdown,
-		emojiReplacer,
-		linkReplacer,
-	)
-	if err != nil {
-		errLog.Fatalf(
-			"failed populating initial cache %v",
-			err,
+		if err != nil {
+			errLog.Fatalf(
+				"failed creating client for %v %v",
+				ic.Name,
+				err,
+			)
+		}
+
+		// Each instance needs its own snapshot and cache directory.
+		opts := s.cacheOptions()
+		opts.Host = ic.host()
+		if len(cfg.Instances) > 1 {
+			if opts.SnapshotPath != "" {
+				opts.SnapshotPath += "." + ic.Name
+			}
+			if opts.Dir != "" {
+				opts.Dir = filepath.Join(opts.Dir, ic.Name)
+			}
+		}
+		c, err := cache.Initialize(
+			cli,
+			infoLog,
+			errLog,
+			markdown,
+			emojiReplacer,
+			linkReplacer,
+			opts,
 		)
-	}
-	app := &application{
-		infoLog:   infoLog,
-		errLog:    errLog,
-		cache:     cache,
-		client:    cli,
-		templates: templates,
+		if err != nil {
+			errLog.Fatalf(
+				"failed populating initial cache for %v %v",
+				ic.Name,
+				err,
+			)
+		}
+		text := &plain.Renderer{
+			Cache:        c,
+			Client:       cli,
+			Markdown:     markdown,
+			CommentDepth: s.commentDepth,
+			CommentTop:   s.commentTop,
+		}
+
+		// The instance is served at the root of its hosts and under its
+		// path prefix on any host.
+		app := &application{
+			infoLog: infoLog,
+			errLog:  errLog,
+			live:    live,
+			cache:   c,
+			client:  cli,
+			text:    text,
+			domain:  ic.Domain,
+
+			instance:    ic.Name,
+			title:       ic.Title,
+			description: ic.Description,
+			motd:        ic.MOTD,
+
+			upstreamTimeout: s.upstreamTimeout,
+
+			commentDepth:    s.commentDepth,
+			commentTop:      s.commentTop,
+			commentMaxDepth: s.commentMaxDepth,
+			commentMaxTop:   s.commentMaxTop,
+		}
+		prefixed := *app
+		prefixed.base = INSTANCE_PREFIX + ic.Name
+		root, err := app.handler()
+		if err != nil {
+			errLog.Fatal(err)
+		}
+		prefixedRoot, err := prefixed.handler()
+		if err != nil {
+			errLog.Fatal(err)
+		}
+
+		if mux == nil {
+			mux = newInstanceMux(root)
+			defaultClient = cli
+			defaultText = text
+		}
+		for _, host := range ic.Hosts {
+			mux.handleHost(host, root)
+		}
+		mux.handlePrefix(ic.Name, prefixedRoot)
+		geminiInstances[prefixed.base] = gemini.Instance{Cache: c, Client: cli}
+		gopherInstances[prefixed.base] = text
+		caches = append(caches, c)
 	}
 
 	srv := &http.Server{
-		Addr:     *addr,
+		Addr:     s.addr,
 		ErrorLog: errLog,
-		Handler:  app.routes(),
+		Handler:  mux,
+
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+	}
+
+	// Watch for requests to shut down before serving anything, they're
+	// handled once the servers are running.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Reload the config file when asked, applying what can be changed
+	// while running. Notify is called first so a SIGHUP never falls through
+	// to the default action of exiting.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, nextCfg, err := loadSettings(os.Args[1:])
+			if err != nil {
+				errLog.Println("failed reloading config:", err)
+				continue
+			}
+			applyLive(next, live, infoLog, debugLog, errLog)
+			for _, c := range caches {
+				c.Reload(next.cacheOptions())
+			}
+			infoLog.Println("reloaded config")
+			names := s.restartNeeded(next)
+			if !reflect.DeepEqual(cfg.Instances, nextCfg.Instances) {
+				names = append(names, "instances")
+			}
+			if len(names) > 0 {
+				infoLog.Println(
+					"restart to apply changes to:",
+					strings.Join(names, ", "),
+				)
+			}
+		}
+	}()
+
+	ls, err := inheritListeners()
+	if err != nil {
+		errLog.Fatal(err)
+	}
+	ln, err := ls.listen("http", s.addr)
+	if err != nil {
+		errLog.Fatal(err)
+	}
+
+	var gs *gemini.Server
+	if s.geminiAddr != "" {
+		host := s.geminiHost
+		if host == "" {
+			u, err := url.Parse(s.domain)
+			if err != nil || u.Hostname() == "" {
+				errLog.Fatalf("failed finding gemini host in domain %v", s.domain)
+			}
+			host = u.Hostname()
+		}
+		gs = &gemini.Server{
+			Addr:     s.geminiAddr,
+			Host:     host,
+			CertFile: s.geminiCert,
+			KeyFile:  s.geminiKey,
+
+			Cache:     defaultText.Cache,
+			Client:    defaultClient,
+			Instances: geminiInstances,
+			Markdown:  markdown,
+			InfoLog:   infoLog,
+			ErrLog:    errLog,
+
+			UpstreamTimeout: s.upstreamTimeout,
+			CommentDepth:    s.commentDepth,
+			CommentTop:      s.commentTop,
+		}
+		gln, err := ls.listen("gemini", s.geminiAddr)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+		go func() {
+			err := gs.Serve(gln)
+			if !errors.Is(err, gemini.ErrServerClosed) {
+				errLog.Fatal(err)
+			}
+		}()
 	}
 
-	infoLog.Println("starting server on", *addr)
-	err = srv.ListenAndServe()
-	errLog.Fatal(err)
+	var ps *gopher.Server
+	if s.gopherAddr != "" {
+		host := s.gopherHost
+		if host == "" {
+			u, err := url.Parse(s.domain)
+			if err != nil || u.Hostname() == "" {
+				errLog.Fatalf("failed finding gopher host in domain %v", s.domain)
+			}
+			host = u.Hostname()
+		}
+		pln, err := ls.listen("gopher", s.gopherAddr)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+		port := s.gopherPort
+		if port == 0 {
+			addr, ok := pln.Addr().(*net.TCPAddr)
+			if !ok {
+				errLog.Fatalf("failed finding gopher port in %v", pln.Addr())
+			}
+			port = addr.Port
+		}
+		ps = &gopher.Server{
+			Addr: s.gopherAddr,
+			Host: host,
+			Port: port,
+
+			Renderer:  defaultText,
+			Instances: gopherInstances,
+			InfoLog:   infoLog,
+			ErrLog:    errLog,
+
+			UpstreamTimeout: s.upstreamTimeout,
+		}
+		go func() {
+			err := ps.Serve(pln)
+			if !errors.Is(err, gopher.ErrServerClosed) {
+				errLog.Fatal(err)
+			}
+		}()
+	}
+	ls.closeUnused()
+
+	// Shut down gracefully when asked, letting open requests and background
+	// fetches finish before saving the cache.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stop
+		signal.Stop(stop)
+
+		infoLog.Println("shutting down")
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			s.shutdownTimeout,
+		)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			errLog.Println("failed draining http connections:", err)
+		}
+		if gs != nil {
+			err := gs.Shutdown(ctx)
+			if err != nil {
+				errLog.Println("failed draining gemini connections:", err)
+			}
+		}
+		if ps != nil {
+			err := ps.Shutdown(ctx)
+			if err != nil {
+				errLog.Println("failed draining gopher connections:", err)
+			}
+		}
+		for _, c := range caches {
+			err := c.Close(ctx)
+			if err != nil {
+				errLog.Println(err)
+			}
+		}
+	}()
+
+	infoLog.Println("starting server on", ln.Addr())
+	err = srv.Serve(ln)
+	if !errors.Is(err, http.ErrServerClosed) {
+		errLog.Fatal(err)
+	}
+	<-stopped
+	infoLog.Println("stopped")
+}
+
+// applyLive applies the settings which can change while running.
+func applyLive(
+	s *settings,
+	live *live,
+	infoLog *log.Logger,
+	debugLog *log.Logger,
+	errLog *log.Logger,
+) {
+	live.csp.Store(&s.csp)
+	live.logRequests.Store(s.logRequests)
+
+	if s.logDebug {
+		debugLog.SetOutput(os.Stdout)
+	} else {
+		debugLog.SetOutput(io.Discard)
+	}
+	for _, l := range []*log.Logger{infoLog, debugLog, errLog} {
+		flags := l.Flags() &^ log.LUTC
+		if s.logUTC {
+			flags |= log.LUTC
+		}
+		l.SetFlags(flags)
+	}
 }
@@ -6,8 +6,27 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
+// CSP is the default Content-Security-Policy. NONCE is replaced with a new
+// nonce for each request.
+const (
+	CSP = "default-src 'none'; " +
+		"script-src 'nonce-" + NONCE + "'; " +
+		"style-src 'nonce-" + NONCE + "'; " +
+		"img-src 'self' https: data:"
+	NONCE = "{nonce}"
+)
+
+// live holds the settings which are changed when the config file is
+// reloaded. It's shared by every application.
+type live struct {
+	csp         atomic.Pointer[string]
+	logRequests atomic.Bool
+}
+
 // cspNonce securely generates a 128bit base64 encoded number.
 func cspNonce() (string, error) {
 	b := make([]byte, 16)
@@ -22,14 +41,12 @@ func (app *application) secureHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		nonce, err := cspNonce()
 		if err != nil {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 			return
 		}
 		w.Header().Set(
 			"Content-Security-Policy",
-			"default-src 'none'; script-src 'nonce-"+
-				nonce+"'; style-src 'nonce-"+
-				nonce+"'; img-src 'self' https: data:",
+			strings.ReplaceAll(*app.live.csp.Load(), NONCE, nonce),
 		)
 		w.Header().Set("Referrer-Policy", "no-referrer")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -52,6 +69,10 @@ func nonce(c context.Context) string {
 // logRequest is a middleware that prints each request to the info log.
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.live.logRequests.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
 		app.infoLog.Printf(
 			"%s - %s %s %s",
 			r.RemoteAddr,
@@ -69,7 +90,7 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 
@@ -0,0 +1,77 @@
+package plain
+
+import (
+	"strings"
+
+	"git.sr.ht/~kota/hex/display"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdown adds markdown to the document as plain text with each line
+// starting with indent.
+func (r *Renderer) markdown(d *Doc, indent string, markdown string) {
+	src := []byte(markdown)
+	doc := r.Markdown.Parser().Parse(text.NewReader(src))
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if n != doc.FirstChild() {
+			d.Lines = append(d.Lines, strings.TrimRight(indent, " "))
+		}
+		writeBlock(d, n, src, indent, r.Cache.Host())
+	}
+}
+
+// writeBlock adds a block node to the document with each line starting with
+// indent. Links to pages on host are made site relative.
+func writeBlock(d *Doc, n ast.Node, src []byte, indent string, host string) {
+	switch n := n.(type) {
+	case *ast.Heading:
+		text := strings.ToUpper(inline(d, n, src, host))
+		d.write(indent, indent, text)
+	case *ast.Paragraph, *ast.TextBlock:
+		d.write(indent, indent, inline(d, n, src, host))
+	case *ast.List:
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+				if _, ok := c.(*ast.List); ok {
+					writeBlock(d, c, src, indent+"  ", host)
+					continue
+				}
+				first := indent + "  "
+				if c == item.FirstChild() {
+					first = indent + "* "
+				}
+				d.write(first, indent+"  ", inline(d, c, src, host))
+			}
+		}
+	case *ast.Blockquote:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			writeBlock(d, c, src, indent+"> ", host)
+		}
+	case *ast.FencedCodeBlock, *ast.CodeBlock, *ast.HTMLBlock:
+		for _, line := range display.CodeLines(n, src) {
+			d.Lines = append(d.Lines, indent+"    "+line)
+		}
+	case *ast.ThematicBreak:
+		d.Lines = append(d.Lines, indent+"----")
+	default:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			writeBlock(d, c, src, indent, host)
+		}
+	}
+}
+
+// inline returns the text of a node's inline children with references added
+// after each link.
+func inline(d *Doc, n ast.Node, src []byte, host string) string {
+	return display.InlineText(
+		n,
+		src,
+		func(url string, label string, image bool) string {
+			if image {
+				return "[" + label + "] " + d.ref(url)
+			}
+			return label + " " + d.ref(display.LocalURL(url, host))
+		},
+	)
+}
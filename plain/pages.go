@@ -0,0 +1,277 @@
+package plain
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/display"
+	"git.sr.ht/~kota/hex/hb"
+	"github.com/yuin/goldmark"
+)
+
+// Renderer renders pages from the cache as plain text documents. The query
+// of each page is the same as on the website.
+type Renderer struct {
+	Cache    *cache.Cache
+	Client   *hb.Client
+	Markdown goldmark.Markdown
+
+	// CommentDepth and CommentTop limit how deeply comments are nested and
+	// how many top level comments are shown on each page of a post.
+	CommentDepth int
+	CommentTop   int
+}
+
+// Home renders the home page.
+func (r *Renderer) Home(ctx context.Context, q url.Values) (*Doc, error) {
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+	sort := hb.ParseSortType(q.Get("sort"))
+	page, err := r.Cache.Home(ctx, r.Client, pageNum, sort)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Doc)
+	d.write("", "", "DIET HEXBEAR")
+	writeStale(d, page.Stale)
+	d.blank()
+	err = r.writePosts(ctx, d, page.PostIDs)
+	if err != nil {
+		return nil, err
+	}
+	writePages(d, "/", q, pageNum, len(page.PostIDs) > 0)
+	return d, nil
+}
+
+// Community renders a page of posts in a community.
+func (r *Renderer) Community(
+	ctx context.Context,
+	name string,
+	q url.Values,
+) (*Doc, error) {
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+	sort := hb.ParseSortType(q.Get("sort"))
+	community, err := r.Cache.Community(ctx, r.Client, name)
+	if err != nil {
+		return nil, err
+	}
+	page, err := r.Cache.CommunityPosts(ctx, r.Client, name, pageNum, sort)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Doc)
+	d.write("", "", strings.ToUpper(community.Name))
+	if community.Description != "" {
+		d.blank()
+		r.markdown(d, "", community.Description)
+	}
+	writeStale(d, page.Stale)
+	d.blank()
+	err = r.writePosts(ctx, d, page.PostIDs)
+	if err != nil {
+		return nil, err
+	}
+	writePages(d, "/c/"+community.Name, q, pageNum, len(page.PostIDs) > 0)
+	return d, nil
+}
+
+// Post renders a post along with a page of its comments. If commentID is set
+// only that comment's thread is shown.
+func (r *Renderer) Post(
+	ctx context.Context,
+	postID int,
+	commentID int,
+	q url.Values,
+) (*Doc, error) {
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+	sort := hb.ParseCommentSortType(q.Get("sort"))
+	post, err := r.Cache.Post(ctx, r.Client, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	var comments cache.PostComments
+	if commentID == 0 {
+		roots := pageNum * r.CommentTop
+		comments, err = r.Cache.Comments(ctx, r.Client, postID, sort, roots)
+	} else {
+		comments, err = r.Cache.Thread(ctx, r.Client, postID, commentID, sort)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Doc)
+	d.write("", "", strings.ToUpper(post.Name))
+	d.write("", "", fmt.Sprintf(
+		"%d bears by %s %s in %s %s",
+		post.Upvotes,
+		post.CreatorDisplayName,
+		display.Since(post.Published),
+		post.CommunityName,
+		d.ref("/c/"+post.CommunityName),
+	))
+	if post.URL != "" {
+		d.write("", "", "Link: "+d.ref(display.LocalURL(post.URL, r.Cache.Host())))
+	}
+	if post.Image != "" {
+		d.write("", "", "Image: "+d.ref(post.Image))
+	}
+	writeStale(d, post.Stale || comments.Stale)
+	if post.BodyMarkdown != "" {
+		d.blank()
+		r.markdown(d, "", post.BodyMarkdown)
+	}
+
+	d.blank()
+	d.write("", "", "COMMENTS")
+	if commentID != 0 {
+		d.write("", "", "View full thread "+d.ref("/post/"+strconv.Itoa(post.ID)))
+	}
+	roots, more := comments.Page(pageNum, r.CommentTop)
+	for _, comment := range roots.Limit(r.CommentDepth) {
+		r.writeComment(d, comment, "")
+	}
+	path := "/post/" + strconv.Itoa(post.ID)
+	if commentID != 0 {
+		path = "/comment/" + strconv.Itoa(commentID)
+	}
+	writePages(d, path, q, pageNum, more)
+	return d, nil
+}
+
+// Comment renders the thread for a single comment.
+func (r *Renderer) Comment(
+	ctx context.Context,
+	commentID int,
+	q url.Values,
+) (*Doc, error) {
+	postID, err := r.Cache.CommentPost(ctx, r.Client, commentID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Post(ctx, postID, commentID, q)
+}
+
+// User renders a user and their posts.
+func (r *Renderer) User(ctx context.Context, name string) (*Doc, error) {
+	user, err := r.Cache.Person(ctx, r.Client, name)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(Doc)
+	d.write("", "", strings.ToUpper(user.DisplayName))
+	if user.BioMarkdown != "" {
+		d.blank()
+		r.markdown(d, "", user.BioMarkdown)
+		d.blank()
+	}
+	d.write("", "", fmt.Sprintf(
+		"%d comments - %d posts",
+		user.CommentCount,
+		user.PostCount,
+	))
+	d.write("", "", fmt.Sprintf(
+		"Joined %s on %s.",
+		display.Since(user.Published),
+		display.Date(user.Published),
+	))
+	writeStale(d, user.Stale)
+	d.blank()
+	err = r.writePosts(ctx, d, user.PostIDs)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// writePosts adds the title of each post with a reference to it, followed by
+// a line about it.
+func (r *Renderer) writePosts(ctx context.Context, d *Doc, ids []int) error {
+	for _, id := range ids {
+		post, err := r.Cache.Post(ctx, r.Client, id)
+		if err != nil {
+			return err
+		}
+		d.write("", "  ", post.Name+" "+d.ref("/post/"+strconv.Itoa(post.ID)))
+		d.write("  ", "  ", fmt.Sprintf(
+			"%d bears %d comments by %s %s in %s",
+			post.Upvotes,
+			post.CommentCount,
+			post.CreatorDisplayName,
+			display.Since(post.Published),
+			post.CommunityName,
+		))
+		d.blank()
+	}
+	return nil
+}
+
+// writeComment adds a comment followed by its replies, each indented one
+// level further.
+func (r *Renderer) writeComment(d *Doc, c *cache.Comment, indent string) {
+	d.blank()
+	if c.Missing {
+		d.write(indent, indent, "[parent comment not loaded]")
+	} else {
+		header := fmt.Sprintf(
+			"%s - %d bears - %s %s",
+			c.CreatorDisplayName,
+			c.Upvotes,
+			display.Since(c.Published),
+			d.ref("/comment/"+strconv.Itoa(c.ID)),
+		)
+		if c.Highlighted {
+			header += " (linked comment)"
+		}
+		d.write(indent, indent, header)
+		r.markdown(d, indent+"| ", c.ContentMarkdown)
+	}
+	for _, child := range c.Children {
+		r.writeComment(d, child, indent+"    ")
+	}
+	if c.MoreReplies > 0 {
+		d.write(indent+"    ", indent+"    ", fmt.Sprintf(
+			"%d more replies, continue thread %s",
+			c.MoreReplies,
+			d.ref("/comment/"+strconv.Itoa(c.ID)),
+		))
+	}
+}
+
+// writeStale notes when the page may be out of date.
+func writeStale(d *Doc, stale bool) {
+	if stale {
+		d.write("", "", display.STALE)
+	}
+}
+
+// writePages adds references to the surrounding pages.
+func writePages(d *Doc, path string, q url.Values, page int, more bool) {
+	var links []string
+	if page > 1 {
+		links = append(links, "prev "+d.ref(path+display.PageURL(q, page-1)))
+	}
+	if more && page < display.MAX_PAGE {
+		links = append(links, "next "+d.ref(path+display.PageURL(q, page+1)))
+	}
+	if len(links) > 0 {
+		d.blank()
+		d.write("", "", strings.Join(links, "  "))
+	}
+}
@@ -0,0 +1,101 @@
+// Package plain renders pages from the cache as plain text, for clients
+// which can't handle even simple HTML. Links are written as numbered
+// references which are listed at the end of each document.
+package plain
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// WIDTH is the column text is wrapped at.
+	WIDTH = 72
+
+	// MIN_WIDTH is the least room text is given when deeply indented.
+	MIN_WIDTH = 30
+)
+
+// Doc is a plain text document.
+type Doc struct {
+	// Lines of text without line endings.
+	Lines []string
+
+	// Refs are the targets of the numbered references in the text, the
+	// first being [1]. Links to pages served here are site relative paths.
+	Refs []string
+}
+
+// Text returns the document followed by its references. Each site relative
+// reference is passed through local, so frontends can adjust them.
+func (d *Doc) Text(local func(string) string) string {
+	var b strings.Builder
+	for _, line := range d.Lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	if len(d.Refs) > 0 {
+		b.WriteString("\nReferences:\n")
+		for i, ref := range d.Refs {
+			if IsLocal(ref) {
+				ref = local(ref)
+			}
+			b.WriteString("[" + strconv.Itoa(i+1) + "] " + ref + "\n")
+		}
+	}
+	return b.String()
+}
+
+// IsLocal reports whether a reference is to a page served here.
+func IsLocal(ref string) bool {
+	return strings.HasPrefix(ref, "/")
+}
+
+// ref adds a reference and returns how it's written in the text. Repeated
+// targets share a number.
+func (d *Doc) ref(target string) string {
+	for i, ref := range d.Refs {
+		if ref == target {
+			return "[" + strconv.Itoa(i+1) + "]"
+		}
+	}
+	d.Refs = append(d.Refs, target)
+	return "[" + strconv.Itoa(len(d.Refs)) + "]"
+}
+
+// blank adds an empty line, unless the document is empty or already ends
+// with one.
+func (d *Doc) blank() {
+	if len(d.Lines) > 0 && d.Lines[len(d.Lines)-1] != "" {
+		d.Lines = append(d.Lines, "")
+	}
+}
+
+// write adds text wrapped to WIDTH with each line starting with indent. The
+// first line starts with first instead, which should be the same width.
+func (d *Doc) write(first, indent, text string) {
+	width := max(WIDTH-utf8.RuneCountInString(indent), MIN_WIDTH)
+	prefix := first
+	for _, paragraph := range strings.Split(text, "\n") {
+		var line strings.Builder
+		var n int
+		for _, word := range strings.Fields(paragraph) {
+			wn := utf8.RuneCountInString(word)
+			if n > 0 && n+1+wn > width {
+				d.Lines = append(d.Lines, prefix+line.String())
+				prefix = indent
+				line.Reset()
+				n = 0
+			}
+			if n > 0 {
+				line.WriteString(" ")
+				n++
+			}
+			line.WriteString(word)
+			n += wn
+		}
+		d.Lines = append(d.Lines, strings.TrimRight(prefix+line.String(), " "))
+		prefix = indent
+	}
+}
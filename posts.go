@@ -1,48 +1,157 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 
 	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/display"
 	"git.sr.ht/~kota/hex/hb"
 	"github.com/julienschmidt/httprouter"
 )
 
+// Default limits on the comments shown on a post's page. Both can be
+// overwritten with launch flags and query parameters.
+const (
+	COMMENT_DEPTH = 8
+	COMMENT_TOP   = 50
+)
+
+// Default maximums for the depth and top query parameters, so a single page
+// can't be made to show every comment.
+const (
+	COMMENT_MAX_DEPTH = 32
+	COMMENT_MAX_TOP   = 200
+)
+
 type postPage struct {
 	CSPNonce    string
 	Post        cache.Post
 	Comments    []*cache.Comment
 	CommentSort string
+	Stale       bool
+
+	// CommentID is set when only a single comment's thread is shown.
+	CommentID int
+
+	// PrevURL and NextURL link to the surrounding pages of top level
+	// comments, if there are any.
+	PrevURL string
+	NextURL string
 }
 
-// post handles requests for displaying a post's comment page.
+// post handles requests for displaying a post's comment page. If a comment is
+// given in the query only that comment's thread is shown.
 func (app *application) post(w http.ResponseWriter, r *http.Request) {
-	sort := hb.ParseCommentSortType(r.URL.Query().Get("sort"))
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	var commentID int
+	if s := r.URL.Query().Get("comment"); s != "" {
+		commentID, err = strconv.Atoi(s)
+		if err != nil || commentID < 1 {
+			app.notFound(w, r)
+			return
+		}
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	app.renderPost(ctx, w, r, id, commentID)
+}
 
+// comment handles requests for displaying a single comment's thread.
+func (app *application) comment(w http.ResponseWriter, r *http.Request) {
 	params := httprouter.ParamsFromContext(r.Context())
 	id, err := strconv.Atoi(params.ByName("id"))
 	if err != nil || id < 1 {
-		app.notFound(w)
+		app.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	postID, err := app.cache.CommentPost(ctx, app.client, id)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	app.renderPost(ctx, w, r, postID, id)
+}
+
+// renderPost renders a post's comment page. Only the thread for the comment
+// is shown unless commentID is 0.
+func (app *application) renderPost(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	id int,
+	commentID int,
+) {
+	q := r.URL.Query()
+	sort := hb.ParseCommentSortType(q.Get("sort"))
+	depth, ok := display.PositiveParam(
+		q,
+		"depth",
+		app.commentDepth,
+		app.commentMaxDepth,
+	)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+	top, ok := display.PositiveParam(q, "top", app.commentTop, app.commentMaxTop)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		app.notFound(w, r)
 		return
 	}
 
-	post, err := app.cache.Post(app.client, id)
-	if err != nil { // TODO: Handle notFound error.
-		app.serverError(w, err)
+	post, err := app.cache.Post(ctx, app.client, id)
+	if err != nil {
+		app.cacheError(w, r, err)
 		return
 	}
 
-	comments, err := app.cache.Comments(app.client, id, sort)
+	var comments cache.PostComments
+	if commentID == 0 {
+		roots := pageNum * top
+		comments, err = app.cache.Comments(ctx, app.client, id, sort, roots)
+	} else {
+		comments, err = app.cache.Thread(ctx, app.client, id, commentID, sort)
+	}
 	if err != nil {
-		app.serverError(w, err)
+		app.cacheError(w, r, err)
 		return
 	}
 
+	// Only one page of top level comments is shown, each limited in depth.
+	roots, more := comments.Page(pageNum, top)
+	var prevURL, nextURL string
+	if pageNum > 1 {
+		prevURL = display.PageURL(q, pageNum-1)
+	}
+	if more && pageNum < display.MAX_PAGE {
+		nextURL = display.PageURL(q, pageNum+1)
+	}
+
 	app.render(w, http.StatusOK, "post.tmpl", postPage{
 		CSPNonce:    nonce(r.Context()),
 		Post:        post,
-		Comments:    comments.Comments,
+		Comments:    roots.Limit(depth),
 		CommentSort: string(sort),
+		Stale:       post.Stale || comments.Stale,
+		CommentID:   commentID,
+		PrevURL:     prevURL,
+		NextURL:     nextURL,
 	})
 }
@@ -14,6 +14,10 @@ import (
 
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(app.notFound)
+	// The router's redirects don't know about the base path.
+	router.RedirectTrailingSlash = app.base == ""
+	router.RedirectFixedPath = app.base == ""
 
 	emojiFS, err := fs.Sub(files.EFS, "emoji")
 	if err != nil {
@@ -22,11 +26,28 @@ func (app *application) routes() http.Handler {
 	fileServer := http.FileServer(http.FS(emojiFS))
 	router.Handler(http.MethodGet, "/pictrs/image/*filepath", http.StripPrefix("/pictrs/image", fileServer))
 
-	router.HandlerFunc(http.MethodGet, "/", app.home)
-	router.HandlerFunc(http.MethodGet, "/post/:id", app.post)
-	router.HandlerFunc(http.MethodGet, "/c/:name", app.community)
-	router.HandlerFunc(http.MethodGet, "/u/:name", app.user)
+	router.HandlerFunc(http.MethodGet, "/", app.textOr(app.home, app.homeText))
+	router.HandlerFunc(http.MethodGet, "/index"+TEXT_SUFFIX, app.homeText)
+	router.HandlerFunc(http.MethodGet, "/post/:id", app.textOr(app.post, app.postText))
+	router.HandlerFunc(http.MethodGet, "/comment/:id", app.textOr(app.comment, app.commentText))
+	router.HandlerFunc(http.MethodGet, "/c/:name", app.textOr(app.community, app.communityText))
+	router.HandlerFunc(http.MethodGet, "/u/:name", app.textOr(app.user, app.userText))
+	for _, f := range []string{RSS_FEED, ATOM_FEED} {
+		router.HandlerFunc(http.MethodGet, "/"+f, app.homeFeed)
+		router.HandlerFunc(http.MethodGet, "/post/:id/"+f, app.postFeed)
+		router.HandlerFunc(http.MethodGet, "/c/:name/"+f, app.communityFeed)
+		router.HandlerFunc(http.MethodGet, "/u/:name/"+f, app.userFeed)
+	}
 	router.HandlerFunc(http.MethodGet, "/communities", app.communities)
+	router.HandlerFunc(http.MethodGet, "/search", app.search)
+	for _, prefix := range []string{"/api/v1", "/api"} {
+		router.HandlerFunc(http.MethodGet, prefix+"/home", app.apiHome)
+		router.HandlerFunc(http.MethodGet, prefix+"/c/:name", app.apiCommunity)
+		router.HandlerFunc(http.MethodGet, prefix+"/post/:id", app.apiPost)
+		router.HandlerFunc(http.MethodGet, prefix+"/post/:id/comments", app.apiComments)
+		router.HandlerFunc(http.MethodGet, prefix+"/u/:name", app.apiUser)
+		router.HandlerFunc(http.MethodGet, prefix+"/communities", app.apiCommunities)
+	}
 	router.HandlerFunc(http.MethodGet, "/ppb", app.ppb)
 	router.HandlerFunc(http.MethodGet, "/robots.txt", app.robots)
 	return app.recoverPanic(app.logRequest(app.secureHeaders(router)))
@@ -38,12 +59,16 @@ func (app *application) render(
 	page string,
 	data interface{},
 ) {
+	// Errors here are reported with a plain http.Error since the error page
+	// itself is rendered with this function.
 	ts, ok := app.templates[page]
 	if !ok {
-		app.serverError(w, fmt.Errorf(
-			"the template %s is missing",
-			page,
-		))
+		app.errLog.Output(2, fmt.Sprintf("the template %s is missing", page))
+		http.Error(
+			w,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
 		return
 	}
 
@@ -51,7 +76,13 @@ func (app *application) render(
 
 	err := ts.ExecuteTemplate(buf, "base", data)
 	if err != nil {
-		app.serverError(w, err)
+		app.errLog.Output(2, err.Error())
+		http.Error(
+			w,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
+		return
 	}
 
 	w.WriteHeader(status)
@@ -62,12 +93,12 @@ func (app *application) render(
 func (app *application) ppb(w http.ResponseWriter, r *http.Request) {
 	f, err := files.EFS.Open("static/ppb.jpg")
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to open ppb.jpg: %v", err))
+		app.serverError(w, r, fmt.Errorf("failed to open ppb.jpg: %v", err))
 		return
 	}
 	data, err := io.ReadAll(f)
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to read ppb.jpg: %v", err))
+		app.serverError(w, r, fmt.Errorf("failed to read ppb.jpg: %v", err))
 		return
 	}
 	w.Write(data)
@@ -76,12 +107,12 @@ func (app *application) ppb(w http.ResponseWriter, r *http.Request) {
 func (app *application) robots(w http.ResponseWriter, r *http.Request) {
 	f, err := files.EFS.Open("static/robots.txt")
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to open robots.txt: %v", err))
+		app.serverError(w, r, fmt.Errorf("failed to open robots.txt: %v", err))
 		return
 	}
 	data, err := io.ReadAll(f)
 	if err != nil {
-		app.serverError(w, fmt.Errorf("failed to read robots.txt: %v", err))
+		app.serverError(w, r, fmt.Errorf("failed to read robots.txt: %v", err))
 		return
 	}
 	w.Write(data)
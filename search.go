@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/display"
+	"git.sr.ht/~kota/hex/hb"
+)
+
+type searchPage struct {
+	CSPNonce  string
+	Query     string
+	Type      string
+	Sort      string
+	Community string
+	Stale     bool
+
+	Posts       []cache.Post
+	Comments    []*cache.Comment
+	Communities []cache.Community
+	Persons     []cache.Person
+
+	// PrevURL and NextURL link to the surrounding pages of results, if there
+	// might be any.
+	PrevURL string
+	NextURL string
+}
+
+// search handles searching hexbear. Without a query only the search form is
+// shown.
+func (app *application) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	searchType := hb.ParseSearchType(q.Get("type"))
+	sort := hb.ParseSortType(q.Get("sort"))
+	if !q.Has("sort") {
+		// Relevance is more useful than activity for search results.
+		sort = hb.SortTypeTopAll
+	}
+	community := strings.TrimSpace(q.Get("community"))
+	pageNum, ok := display.PageParam(q)
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	data := searchPage{
+		CSPNonce:  nonce(r.Context()),
+		Query:     query,
+		Type:      string(searchType),
+		Sort:      string(sort),
+		Community: community,
+	}
+	if query == "" {
+		app.render(w, http.StatusOK, "search.tmpl", data)
+		return
+	}
+
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	results, err := app.cache.Search(
+		ctx,
+		app.client,
+		query,
+		searchType,
+		community,
+		pageNum,
+		sort,
+	)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	for _, id := range results.PostIDs {
+		p, err := app.cache.Post(ctx, app.client, id)
+		if err != nil {
+			app.cacheError(w, r, err)
+			return
+		}
+		data.Posts = append(data.Posts, p)
+	}
+	data.Comments = results.Comments
+	data.Communities = results.Communities
+	data.Persons = results.Persons
+	data.Stale = results.Stale
+
+	if pageNum > 1 {
+		data.PrevURL = display.PageURL(q, pageNum-1)
+	}
+	if len(results.PostIDs) == cache.SEARCH_RESULTS ||
+		len(results.Comments) == cache.SEARCH_RESULTS ||
+		len(results.Communities) == cache.SEARCH_RESULTS ||
+		len(results.Persons) == cache.SEARCH_RESULTS {
+		data.NextURL = display.PageURL(q, pageNum+1)
+	}
+	app.render(w, http.StatusOK, "search.tmpl", data)
+}
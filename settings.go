@@ -0,0 +1,657 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"git.sr.ht/~kota/hex/cache"
+	"git.sr.ht/~kota/hex/hb"
+)
+
+// settings holds every setting. Each is a launch flag and can also be given
+// in the config file, flags take precedence.
+type settings struct {
+	// flags parse into the settings, they're kept to compare settings.
+	flags *flag.FlagSet
+
+	config string
+
+	addr   string
+	hbURL  string
+	domain string
+
+	title       string
+	description string
+	listingType string
+	csp         string
+
+	logDebug    bool
+	logRequests bool
+	logUTC      bool
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	upstreamAttemptTimeout time.Duration
+	upstreamDialTimeout    time.Duration
+	upstreamTLSTimeout     time.Duration
+	upstreamHeaderTimeout  time.Duration
+	upstreamIdleTimeout    time.Duration
+	upstreamMaxIdleConns   int
+	upstreamMaxConns       int
+	upstreamMaxBytes       int64
+
+	retries       int
+	retryDelay    time.Duration
+	retryMaxDelay time.Duration
+	rateLimit     float64
+	burst         int
+	maxInFlight   int
+
+	maxStale     time.Duration
+	pageTTL      time.Duration
+	postTTL      time.Duration
+	personTTL    time.Duration
+	searchTTL    time.Duration
+	communityTTL time.Duration
+	postsPerPage int
+
+	maxPages    int
+	maxPosts    int
+	maxComments int
+	maxPersons  int
+	maxSearches int
+
+	snapshot         string
+	snapshotInterval time.Duration
+	backend          string
+	cacheDir         string
+
+	refreshInterval   time.Duration
+	refreshBudget     int
+	upstreamTimeout   time.Duration
+	backgroundTimeout time.Duration
+	shutdownTimeout   time.Duration
+
+	commentDepth    int
+	commentTop      int
+	commentMaxDepth int
+	commentMaxTop   int
+
+	geminiAddr string
+	geminiHost string
+	geminiCert string
+	geminiKey  string
+
+	gopherAddr string
+	gopherHost string
+	gopherPort int
+}
+
+// LIVE_SETTINGS are the settings applied when the config file is reloaded.
+// Changes to any others are only applied on restart.
+var LIVE_SETTINGS = []string{
+	"csp",
+	"log-debug",
+	"log-requests",
+	"log-utc",
+	"max-stale",
+	"page-ttl",
+	"post-ttl",
+	"person-ttl",
+	"search-ttl",
+	"community-ttl",
+}
+
+// flagSet returns a flag set which parses into s. Every setting starts at its
+// default.
+func (s *settings) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("hex", flag.ContinueOnError)
+	fs.StringVar(
+		&s.config,
+		"config",
+		"",
+		"config file of settings and instances, see extras/config.example.json",
+	)
+	fs.StringVar(&s.addr, "addr", ":4000", "HTTP network address")
+	fs.StringVar(&s.hbURL, "hb", hb.BaseURL, "hexbear baseURL")
+	fs.StringVar(&s.domain, "domain", DOMAIN, "domain name for link replacement")
+	fs.StringVar(&s.title, "title", TITLE, "title shown on each page")
+	fs.StringVar(
+		&s.description,
+		"description",
+		DESCRIPTION,
+		"description of the site for search engines",
+	)
+	fs.StringVar(
+		&s.listingType,
+		"listing-type",
+		"local",
+		"which posts are listed: local or all",
+	)
+	fs.StringVar(
+		&s.csp,
+		"csp",
+		CSP,
+		"Content-Security-Policy header, "+NONCE+" is replaced with a nonce",
+	)
+	fs.BoolVar(&s.logDebug, "log-debug", true, "log each hexbear request")
+	fs.BoolVar(&s.logRequests, "log-requests", true, "log each HTTP request")
+	fs.BoolVar(&s.logUTC, "log-utc", false, "log times in UTC")
+	fs.DurationVar(
+		&s.readHeaderTimeout,
+		"read-header-timeout",
+		READ_HEADER_TIMEOUT,
+		"maximum time to read the headers of an HTTP request",
+	)
+	fs.DurationVar(
+		&s.readTimeout,
+		"read-timeout",
+		READ_TIMEOUT,
+		"maximum time to read an HTTP request",
+	)
+	fs.DurationVar(
+		&s.writeTimeout,
+		"write-timeout",
+		WRITE_TIMEOUT,
+		"maximum time to handle and write an HTTP response, longer than upstream-timeout",
+	)
+	fs.DurationVar(
+		&s.idleTimeout,
+		"idle-timeout",
+		IDLE_TIMEOUT,
+		"maximum time to keep an idle HTTP connection open",
+	)
+	fs.IntVar(
+		&s.maxHeaderBytes,
+		"max-header-bytes",
+		MAX_HEADER_BYTES,
+		"maximum size of the headers of an HTTP request",
+	)
+	fs.DurationVar(
+		&s.upstreamAttemptTimeout,
+		"upstream-attempt-timeout",
+		hb.DefaultTransportPolicy.Timeout,
+		"maximum time for each attempt at a hexbear request",
+	)
+	fs.DurationVar(
+		&s.upstreamDialTimeout,
+		"upstream-dial-timeout",
+		hb.DefaultTransportPolicy.DialTimeout,
+		"maximum time to connect to hexbear",
+	)
+	fs.DurationVar(
+		&s.upstreamTLSTimeout,
+		"upstream-tls-timeout",
+		hb.DefaultTransportPolicy.TLSHandshakeTimeout,
+		"maximum time for the TLS handshake with hexbear",
+	)
+	fs.DurationVar(
+		&s.upstreamHeaderTimeout,
+		"upstream-header-timeout",
+		hb.DefaultTransportPolicy.ResponseHeaderTimeout,
+		"maximum time to wait on the headers of a hexbear response",
+	)
+	fs.DurationVar(
+		&s.upstreamIdleTimeout,
+		"upstream-idle-timeout",
+		hb.DefaultTransportPolicy.IdleConnTimeout,
+		"how long an unused connection to hexbear is kept open",
+	)
+	fs.IntVar(
+		&s.upstreamMaxIdleConns,
+		"upstream-max-idle-conns",
+		hb.DefaultTransportPolicy.MaxIdleConns,
+		"maximum unused connections to hexbear kept open, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.upstreamMaxConns,
+		"upstream-max-conns",
+		hb.DefaultTransportPolicy.MaxConnsPerHost,
+		"maximum connections to hexbear open at once, 0 for no limit",
+	)
+	fs.Int64Var(
+		&s.upstreamMaxBytes,
+		"upstream-max-bytes",
+		hb.DefaultTransportPolicy.MaxResponseBytes,
+		"maximum size of a hexbear response, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.retries,
+		"retries",
+		hb.DefaultRetryPolicy.MaxAttempts,
+		"maximum attempts for each hexbear request, including the first",
+	)
+	fs.DurationVar(
+		&s.retryDelay,
+		"retry-delay",
+		hb.DefaultRetryPolicy.BaseDelay,
+		"delay before retrying a failed hexbear request",
+	)
+	fs.DurationVar(
+		&s.retryMaxDelay,
+		"retry-max-delay",
+		hb.DefaultRetryPolicy.MaxDelay,
+		"maximum delay between retries of a hexbear request",
+	)
+	fs.Float64Var(
+		&s.rateLimit,
+		"rate",
+		hb.DefaultRateLimit,
+		"maximum hexbear requests per second, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.burst,
+		"burst",
+		hb.DefaultBurst,
+		"maximum burst of hexbear requests above the rate limit",
+	)
+	fs.IntVar(
+		&s.maxInFlight,
+		"max-in-flight",
+		hb.DefaultMaxInFlight,
+		"maximum concurrent hexbear requests, 0 for no limit",
+	)
+	fs.DurationVar(
+		&s.maxStale,
+		"max-stale",
+		cache.MAX_STALE,
+		"maximum age of expired data served while hexbear is refreshed",
+	)
+	fs.DurationVar(
+		&s.pageTTL,
+		"page-ttl",
+		cache.PAGE_TTL,
+		"how long pages of posts are cached",
+	)
+	fs.DurationVar(
+		&s.postTTL,
+		"post-ttl",
+		cache.POST_TTL,
+		"how long posts and their comments are cached",
+	)
+	fs.DurationVar(
+		&s.personTTL,
+		"person-ttl",
+		cache.PERSON_TTL,
+		"how long users are cached",
+	)
+	fs.DurationVar(
+		&s.searchTTL,
+		"search-ttl",
+		cache.SEARCH_TTL,
+		"how long search results are cached",
+	)
+	fs.DurationVar(
+		&s.communityTTL,
+		"community-ttl",
+		cache.COMMUNITY_TTL,
+		"how long the list of communities is cached",
+	)
+	fs.IntVar(
+		&s.postsPerPage,
+		"posts-per-page",
+		cache.POSTS_PER_PAGE,
+		"posts on each page, at most 50",
+	)
+	fs.IntVar(
+		&s.maxPages,
+		"max-pages",
+		cache.MAX_PAGES,
+		"maximum cached pages of posts, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.maxPosts,
+		"max-posts",
+		cache.MAX_POSTS,
+		"maximum cached posts, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.maxComments,
+		"max-comments",
+		cache.MAX_COMMENTS,
+		"maximum posts with cached comments, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.maxPersons,
+		"max-persons",
+		cache.MAX_PERSONS,
+		"maximum cached users, 0 for no limit",
+	)
+	fs.IntVar(
+		&s.maxSearches,
+		"max-searches",
+		cache.MAX_SEARCHES,
+		"maximum cached pages of search results, 0 for no limit",
+	)
+	fs.StringVar(
+		&s.snapshot,
+		"snapshot",
+		"",
+		"file to save the cache to and load it from on startup",
+	)
+	fs.DurationVar(
+		&s.snapshotInterval,
+		"snapshot-interval",
+		cache.SNAPSHOT_INTERVAL,
+		"how often to save the cache snapshot",
+	)
+	fs.StringVar(
+		&s.backend,
+		"cache-backend",
+		cache.BackendMemory,
+		"where to store the cache: memory or disk",
+	)
+	fs.StringVar(
+		&s.cacheDir,
+		"cache-dir",
+		"",
+		"directory used by the disk cache backend",
+	)
+	fs.DurationVar(
+		&s.refreshInterval,
+		"refresh-interval",
+		cache.REFRESH_INTERVAL,
+		"how often popular pages are checked for refreshing",
+	)
+	fs.IntVar(
+		&s.refreshBudget,
+		"refresh-budget",
+		cache.REFRESH_BUDGET,
+		"maximum hexbear requests per minute to keep popular pages warm",
+	)
+	fs.DurationVar(
+		&s.upstreamTimeout,
+		"upstream-timeout",
+		time.Second*15,
+		"maximum time a request may wait on hexbear",
+	)
+	fs.DurationVar(
+		&s.backgroundTimeout,
+		"background-timeout",
+		cache.BACKGROUND_TIMEOUT,
+		"maximum time a background refresh may wait on hexbear",
+	)
+	fs.DurationVar(
+		&s.shutdownTimeout,
+		"shutdown-timeout",
+		SHUTDOWN_TIMEOUT,
+		"maximum time to wait on open requests when shutting down",
+	)
+	fs.IntVar(
+		&s.commentDepth,
+		"comment-depth",
+		COMMENT_DEPTH,
+		"default maximum nesting depth of comments shown on a post",
+	)
+	fs.IntVar(
+		&s.commentTop,
+		"comment-top",
+		COMMENT_TOP,
+		"default number of top level comments shown on each page of a post",
+	)
+	fs.IntVar(
+		&s.commentMaxDepth,
+		"comment-max-depth",
+		COMMENT_MAX_DEPTH,
+		"maximum nesting depth of comments which may be asked for",
+	)
+	fs.IntVar(
+		&s.commentMaxTop,
+		"comment-max-top",
+		COMMENT_MAX_TOP,
+		"maximum top level comments which may be asked for on each page",
+	)
+	fs.StringVar(
+		&s.geminiAddr,
+		"gemini-addr",
+		"",
+		"Gemini network address, the Gemini server is disabled if empty.\nInstances other than the first are served under /i/<name>/",
+	)
+	fs.StringVar(
+		&s.geminiHost,
+		"gemini-host",
+		"",
+		"hostname for the generated Gemini certificate, defaults to the domain",
+	)
+	fs.StringVar(
+		&s.geminiCert,
+		"gemini-cert",
+		"gemini.crt",
+		"Gemini TLS certificate, a self signed one is created if missing",
+	)
+	fs.StringVar(
+		&s.geminiKey,
+		"gemini-key",
+		"gemini.key",
+		"Gemini TLS key, created along with the certificate if missing",
+	)
+	fs.StringVar(
+		&s.gopherAddr,
+		"gopher-addr",
+		"",
+		"Gopher network address, the Gopher server is disabled if empty.\nInstances other than the first are served under /i/<name>/",
+	)
+	fs.StringVar(
+		&s.gopherHost,
+		"gopher-host",
+		"",
+		"hostname given to Gopher clients in menus, defaults to the domain",
+	)
+	fs.IntVar(
+		&s.gopherPort,
+		"gopher-port",
+		0,
+		"port given to Gopher clients in menus, defaults to the listening port",
+	)
+	return fs
+}
+
+// loadSettings parses the flags in args followed by the config file they
+// name, if any. Settings in the config file are used unless the same flag was
+// given. The settings and instances are validated.
+func loadSettings(args []string) (*settings, config, error) {
+	s := new(settings)
+	fs := s.flagSet()
+	s.flags = fs
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, config{}, err
+	}
+
+	var cfg config
+	if s.config != "" {
+		cfg, err = loadConfig(s.config)
+		if err != nil {
+			return nil, config{}, err
+		}
+		given := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		for name, value := range cfg.Settings {
+			if name == "config" || fs.Lookup(name) == nil {
+				return nil, config{}, fmt.Errorf(
+					"unknown setting %q in config %v",
+					name,
+					s.config,
+				)
+			}
+			if given[name] {
+				continue
+			}
+			err := fs.Set(name, value)
+			if err != nil {
+				return nil, config{}, fmt.Errorf(
+					"invalid setting %q in config %v: %w",
+					name,
+					s.config,
+					err,
+				)
+			}
+		}
+	}
+
+	err = s.validate()
+	if err != nil {
+		return nil, config{}, err
+	}
+	err = cfg.fillInstances(s)
+	if err != nil {
+		return nil, config{}, err
+	}
+	return s, cfg, nil
+}
+
+// validate checks that the settings make sense together.
+func (s *settings) validate() error {
+	var errs []error
+	if _, ok := listingTypes[strings.ToLower(s.listingType)]; !ok {
+		errs = append(errs, fmt.Errorf(
+			"listing-type must be local or all, not %q",
+			s.listingType,
+		))
+	}
+	if s.backend != cache.BackendMemory && s.backend != cache.BackendDisk {
+		errs = append(errs, fmt.Errorf(
+			"cache-backend must be memory or disk, not %q",
+			s.backend,
+		))
+	}
+	if s.backend == cache.BackendDisk && s.cacheDir == "" {
+		errs = append(errs, errors.New("cache-dir is needed by the disk backend"))
+	}
+	if s.postsPerPage < 1 || s.postsPerPage > cache.POSTS_PER_PAGE {
+		errs = append(errs, fmt.Errorf(
+			"posts-per-page must be between 1 and %d",
+			cache.POSTS_PER_PAGE,
+		))
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"max-stale", s.maxStale},
+		{"page-ttl", s.pageTTL},
+		{"post-ttl", s.postTTL},
+		{"person-ttl", s.personTTL},
+		{"search-ttl", s.searchTTL},
+		{"community-ttl", s.communityTTL},
+		{"upstream-timeout", s.upstreamTimeout},
+		{"background-timeout", s.backgroundTimeout},
+		{"shutdown-timeout", s.shutdownTimeout},
+		{"read-header-timeout", s.readHeaderTimeout},
+		{"read-timeout", s.readTimeout},
+		{"write-timeout", s.writeTimeout},
+		{"idle-timeout", s.idleTimeout},
+		{"upstream-attempt-timeout", s.upstreamAttemptTimeout},
+		{"upstream-dial-timeout", s.upstreamDialTimeout},
+		{"upstream-tls-timeout", s.upstreamTLSTimeout},
+		{"upstream-header-timeout", s.upstreamHeaderTimeout},
+		{"upstream-idle-timeout", s.upstreamIdleTimeout},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%v must be positive", d.name))
+		}
+	}
+	// Responses which wait on hexbear would be cut off.
+	if s.writeTimeout <= s.upstreamTimeout {
+		errs = append(errs, errors.New("write-timeout must be longer than upstream-timeout"))
+	}
+	if s.maxHeaderBytes < 1 {
+		errs = append(errs, errors.New("max-header-bytes must be positive"))
+	}
+	if s.upstreamMaxIdleConns < 0 || s.upstreamMaxConns < 0 || s.upstreamMaxBytes < 0 {
+		errs = append(errs, errors.New("upstream limits can't be negative"))
+	}
+	if s.retries < 1 {
+		errs = append(errs, errors.New("retries must be at least 1"))
+	}
+	if s.commentDepth < 1 || s.commentTop < 1 {
+		errs = append(errs, errors.New("comment-depth and comment-top must be at least 1"))
+	}
+	if s.commentMaxDepth < s.commentDepth || s.commentMaxTop < s.commentTop {
+		errs = append(errs, errors.New(
+			"comment-max-depth and comment-max-top can't be below comment-depth and comment-top",
+		))
+	}
+	if s.gopherPort < 0 || s.gopherPort > 65535 {
+		errs = append(errs, errors.New("gopher-port must be a valid port"))
+	}
+	return errors.Join(errs...)
+}
+
+// listingTypes maps the allowed values of the listing-type setting to what
+// they're called by hexbear. Subscribed listings need an account.
+var listingTypes = map[string]hb.ListingType{
+	"local": hb.ListingTypeLocal,
+	"all":   hb.ListingTypeAll,
+}
+
+// transportPolicy returns the policy for the client used to reach hexbear.
+func (s *settings) transportPolicy() hb.TransportPolicy {
+	return hb.TransportPolicy{
+		Timeout:               s.upstreamAttemptTimeout,
+		DialTimeout:           s.upstreamDialTimeout,
+		TLSHandshakeTimeout:   s.upstreamTLSTimeout,
+		ResponseHeaderTimeout: s.upstreamHeaderTimeout,
+		IdleConnTimeout:       s.upstreamIdleTimeout,
+		MaxIdleConns:          s.upstreamMaxIdleConns,
+		MaxConnsPerHost:       s.upstreamMaxConns,
+		MaxResponseBytes:      s.upstreamMaxBytes,
+	}
+}
+
+// cacheOptions returns the cache options for the settings.
+func (s *settings) cacheOptions() cache.Options {
+	return cache.Options{
+		MaxStale:     s.maxStale,
+		CommunityTTL: s.communityTTL,
+		PageTTL:      s.pageTTL,
+		PostTTL:      s.postTTL,
+		PersonTTL:    s.personTTL,
+		SearchTTL:    s.searchTTL,
+
+		PostsPerPage: s.postsPerPage,
+		ListingType:  listingTypes[strings.ToLower(s.listingType)],
+
+		MaxPages:    s.maxPages,
+		MaxPosts:    s.maxPosts,
+		MaxComments: s.maxComments,
+		MaxPersons:  s.maxPersons,
+		MaxSearches: s.maxSearches,
+
+		SnapshotPath:     s.snapshot,
+		SnapshotInterval: s.snapshotInterval,
+
+		Backend: s.backend,
+		Dir:     s.cacheDir,
+
+		RefreshInterval: s.refreshInterval,
+		RefreshBudget:   s.refreshBudget,
+
+		BackgroundTimeout: s.backgroundTimeout,
+	}
+}
+
+// restartNeeded returns the names of settings which differ between s and
+// next but can't be applied while running.
+func (s *settings) restartNeeded(next *settings) []string {
+	var names []string
+	s.flags.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(LIVE_SETTINGS, f.Name) {
+			return
+		}
+		if f.Value.String() != next.flags.Lookup(f.Name).Value.String() {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
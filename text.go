@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~kota/hex/plain"
+	"github.com/julienschmidt/httprouter"
+)
+
+// TEXT_SUFFIX is added to a page's path to request it as plain text.
+const TEXT_SUFFIX = ".txt"
+
+// textOr returns a handler which serves the plain text version of a page
+// when it's asked for, either with the TEXT_SUFFIX or the Accept header.
+func (app *application) textOr(html, text http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if strings.HasSuffix(r.URL.Path, TEXT_SUFFIX) || prefersText(r) {
+			text(w, r)
+			return
+		}
+		html(w, r)
+	}
+}
+
+// isText reports whether a request is for a plain text page.
+func isText(r *http.Request) bool {
+	return r.URL.Path != "/robots.txt" &&
+		(strings.HasSuffix(r.URL.Path, TEXT_SUFFIX) || prefersText(r))
+}
+
+// prefersText reports whether the Accept header ranks text/plain above
+// text/html. Wildcards are ignored since every browser sends them.
+func prefersText(r *http.Request) bool {
+	var textQ, htmlQ float64
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(s, 64)
+				if err != nil {
+					continue
+				}
+			}
+			switch mediaType {
+			case "text/plain":
+				textQ = max(textQ, q)
+			case "text/html":
+				htmlQ = max(htmlQ, q)
+			}
+		}
+	}
+	return textQ > htmlQ
+}
+
+// textLink returns the plain text version of a site relative link.
+func (app *application) textLink(link string) string {
+	path, query, _ := strings.Cut(link, "?")
+	if path == "/" {
+		path = "/index"
+	}
+	path += TEXT_SUFFIX
+	if query != "" {
+		path += "?" + query
+	}
+	return app.base + path
+}
+
+// textParam returns a route parameter without the TEXT_SUFFIX.
+func textParam(r *http.Request, name string) string {
+	params := httprouter.ParamsFromContext(r.Context())
+	return strings.TrimSuffix(params.ByName(name), TEXT_SUFFIX)
+}
+
+// writeText writes a plain text document as the response.
+func (app *application) writeText(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	doc *plain.Doc,
+) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(doc.Text(app.textLink)))
+}
+
+// renderText writes the document returned by page, or an error page if it
+// fails.
+func (app *application) renderText(
+	w http.ResponseWriter,
+	r *http.Request,
+	page func(ctx context.Context) (*plain.Doc, error),
+) {
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	doc, err := page(ctx)
+	if err != nil {
+		app.cacheError(w, r, err)
+		return
+	}
+	app.writeText(w, r, http.StatusOK, doc)
+}
+
+// homeText handles requests for the plain text home page.
+func (app *application) homeText(w http.ResponseWriter, r *http.Request) {
+	app.renderText(w, r, func(ctx context.Context) (*plain.Doc, error) {
+		return app.text.Home(ctx, r.URL.Query())
+	})
+}
+
+// communityText handles requests for a community's plain text page.
+func (app *application) communityText(w http.ResponseWriter, r *http.Request) {
+	name := textParam(r, "name")
+	app.renderText(w, r, func(ctx context.Context) (*plain.Doc, error) {
+		return app.text.Community(ctx, name, r.URL.Query())
+	})
+}
+
+// postText handles requests for a post's plain text page.
+func (app *application) postText(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(textParam(r, "id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+
+	var commentID int
+	if s := r.URL.Query().Get("comment"); s != "" {
+		commentID, err = strconv.Atoi(s)
+		if err != nil || commentID < 1 {
+			app.notFound(w, r)
+			return
+		}
+	}
+
+	app.renderText(w, r, func(ctx context.Context) (*plain.Doc, error) {
+		return app.text.Post(ctx, id, commentID, r.URL.Query())
+	})
+}
+
+// commentText handles requests for a comment thread's plain text page.
+func (app *application) commentText(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(textParam(r, "id"))
+	if err != nil || id < 1 {
+		app.notFound(w, r)
+		return
+	}
+	app.renderText(w, r, func(ctx context.Context) (*plain.Doc, error) {
+		return app.text.Comment(ctx, id, r.URL.Query())
+	})
+}
+
+// userText handles requests for a user's plain text page.
+func (app *application) userText(w http.ResponseWriter, r *http.Request) {
+	name := textParam(r, "name")
+	app.renderText(w, r, func(ctx context.Context) (*plain.Doc, error) {
+		return app.text.User(ctx, name)
+	})
+}
@@ -16,6 +16,7 @@ type userPage struct {
 	CommentCount int
 	PostCount    int
 	Created      time.Time
+	Stale        bool
 
 	Posts []cache.Post
 }
@@ -24,17 +25,19 @@ type userPage struct {
 func (app *application) user(w http.ResponseWriter, r *http.Request) {
 	params := httprouter.ParamsFromContext(r.Context())
 	name := params.ByName("name")
-	user, err := app.cache.Person(app.client, name)
+	ctx, cancel := app.upstreamContext(r)
+	defer cancel()
+	user, err := app.cache.Person(ctx, app.client, name)
 	if err != nil {
-		app.clientError(w, http.StatusNotFound) // TODO: Handle server errors vs notFound error.
+		app.cacheError(w, r, err)
 		return
 	}
 
 	var posts []cache.Post
 	for _, id := range user.PostIDs {
-		p, err := app.cache.Post(app.client, id)
+		p, err := app.cache.Post(ctx, app.client, id)
 		if err != nil {
-			app.serverError(w, err)
+			app.cacheError(w, r, err)
 			return
 		}
 		posts = append(posts, p)
@@ -47,6 +50,7 @@ func (app *application) user(w http.ResponseWriter, r *http.Request) {
 		CommentCount: user.CommentCount,
 		PostCount:    user.PostCount,
 		Created:      user.Published,
+		Stale:        user.Stale,
 
 		Posts: posts,
 	})